@@ -0,0 +1,390 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/grant"
+	"whoam.xyz/ent/oauth"
+	"whoam.xyz/ent/service"
+	"whoam.xyz/ent/session"
+	"whoam.xyz/ent/user"
+)
+
+// localeTag is the language tag of the profile, such as en or zh-CN, see BCP 47
+var localeTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// accountAuthorization is an active refresh token family of the user for a service
+type accountAuthorization struct {
+	ID           int       `json:"id"` // ID of the current refresh token record of the family
+	Scope        string    `json:"scope"`
+	AuthorizedAt time.Time `json:"authorized_at"`
+	RefreshedAt  time.Time `json:"refreshed_at"`
+	ExpiredAt    time.Time `json:"expired_at"`
+}
+
+// accountService is a service which the user has authorized
+type accountService struct {
+	ID           string                  `json:"id"`
+	Name         string                  `json:"name"`
+	Domain       string                  `json:"domain"`
+	Verified     bool                    `json:"verified"`
+	Scopes       []string                `json:"scopes"`
+	AuthorizedAt time.Time               `json:"authorized_at"`          // The first authorization of the active families, or the grant
+	RefreshedAt  *time.Time              `json:"refreshed_at,omitempty"` // The last refresh of the active families
+	ExpiredAt    *time.Time              `json:"expired_at,omitempty"`   // The expiry of the last active family
+	Sessions     []*accountAuthorization `json:"sessions"`
+}
+
+// accountSession is a browser session of the user
+type accountSession struct {
+	ID         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiredAt  time.Time `json:"expired_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// accountServicesOf returns the services the user has authorized, with the active refresh token families,
+// in the order of the first authorization.
+func accountServicesOf(userID int) ([]*accountService, error) {
+	grants, err := client.Grant.Query().
+		Where(grant.HasUserWith(user.IDEQ(userID))).
+		WithService().
+		Order(ent.Asc(grant.FieldCreatedAt)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	auths, err := client.Oauth.Query().
+		Where(oauth.HasUserWith(user.IDEQ(userID))).
+		Where(oauth.HasServiceWith(service.IDNEQ(MainServiceID))).
+		Where(oauth.RotatedAtIsNil()).
+		Where(oauth.ExpiredAtGT(time.Now())).
+		WithService().
+		Order(ent.Asc(oauth.FieldAuthorizedAt)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*accountService
+	index := make(map[string]*accountService)
+	serviceOf := func(_service *ent.Service) *accountService {
+		if s, ok := index[_service.ID]; ok {
+			return s
+		}
+		s := &accountService{
+			ID:       _service.ID,
+			Name:     _service.Name,
+			Domain:   _service.Domain,
+			Verified: service.StatusVerified == _service.Status,
+			Sessions: []*accountAuthorization{},
+		}
+		index[_service.ID] = s
+		services = append(services, s)
+		return s
+	}
+
+	for _, _grant := range grants {
+		s := serviceOf(_grant.Edges.Service)
+		s.Scopes = _grant.Scopes
+		s.AuthorizedAt = _grant.CreatedAt
+	}
+
+	for _, auth := range auths {
+		s := serviceOf(auth.Edges.Service)
+		a := &accountAuthorization{
+			ID:           auth.ID,
+			Scope:        auth.Scope,
+			AuthorizedAt: authorizedAtOf(auth),
+			RefreshedAt:  auth.CreatedAt,
+			ExpiredAt:    auth.ExpiredAt,
+		}
+		s.Sessions = append(s.Sessions, a)
+
+		if s.AuthorizedAt.IsZero() || a.AuthorizedAt.Before(s.AuthorizedAt) {
+			s.AuthorizedAt = a.AuthorizedAt
+		}
+		if s.RefreshedAt == nil || a.RefreshedAt.After(*s.RefreshedAt) {
+			s.RefreshedAt = &a.RefreshedAt
+		}
+		if s.ExpiredAt == nil || a.ExpiredAt.After(*s.ExpiredAt) {
+			s.ExpiredAt = &a.ExpiredAt
+		}
+	}
+
+	return services, nil
+}
+
+// accountSessionsOf returns the active browser sessions of the user, the last used first
+func accountSessionsOf(userID int, current *ent.Session) ([]*accountSession, error) {
+	now := time.Now()
+	sessions, err := client.Session.Query().
+		Where(session.HasUserWith(user.IDEQ(userID))).
+		Where(session.ExpiredAtGT(now)).
+		Where(session.LastUsedAtGT(now.Add(-sessionIdleTimeout()))).
+		Order(ent.Desc(session.FieldLastUsedAt)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*accountSession, len(sessions))
+	for i, s := range sessions {
+		list[i] = &accountSession{
+			ID:         s.ID,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiredAt:  s.ExpiredAt,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			Current:    current != nil && current.ID == s.ID,
+		}
+	}
+	return list, nil
+}
+
+// revokeAccountService revokes all refresh tokens and access tokens of the user for the service,
+// and deletes the grant, so that the user must consent again.
+func revokeAccountService(userID int, serviceID string) error {
+	auths, err := client.Oauth.Query().
+		Where(oauth.HasUserWith(user.IDEQ(userID))).
+		Where(oauth.HasServiceWith(service.IDEQ(serviceID))).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = revokeOAuths(auths...); err != nil {
+		return err
+	}
+
+	_, err = client.Grant.Delete().
+		Where(grant.HasUserWith(user.IDEQ(userID))).
+		Where(grant.HasServiceWith(service.IDEQ(serviceID))).
+		Exec(ctx)
+	return err
+}
+
+// accountEndpoint the page which the user manages the authorized services and the login sessions
+func accountEndpoint(c *Context) error {
+	var response struct {
+		Authorizated bool
+		User         *ent.User
+		CSRFToken    string
+		Services     []*accountService
+		Sessions     []*accountSession
+	}
+
+	_session := sessionOf(c)
+	if _session == nil {
+		return c.OkHTML(tlpUserAccount, &response)
+	}
+
+	var err error
+	response.Authorizated = true
+	response.User = _session.Edges.User
+	response.CSRFToken = _session.CsrfToken
+
+	response.Services, err = accountServicesOf(response.User.ID)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	response.Sessions, err = accountSessionsOf(response.User.ID, _session)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.OkHTML(tlpUserAccount, &response)
+}
+
+// GetAccountServices lists the services the user has authorized
+func GetAccountServices(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	services, err := accountServicesOf(_user.ID)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(services)
+}
+
+// DeleteAccountService revokes the access of the service to the user
+func DeleteAccountService(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	if MainServiceID == c.Param("id") {
+		return c.BadRequest("Log out to revoke the access of whoam")
+	}
+
+	if err = revokeAccountService(_user.ID, c.Param("id")); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// DeleteAccountAuthorization revokes the refresh token family of the record, such as the login on one device
+func DeleteAccountAuthorization(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.BadRequest("Invalid authorization id")
+	}
+
+	auth, err := client.Oauth.Query().
+		Where(oauth.IDEQ(id)).
+		Where(oauth.HasUserWith(user.IDEQ(_user.ID))).
+		Only(ctx)
+	if err != nil {
+		return c.NotFound("Authorization not found")
+	}
+
+	if err = revokeFamily(auth); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// GetAccountSessions lists the browser sessions of the user
+func GetAccountSessions(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	sessions, err := accountSessionsOf(_user.ID, sessionOf(c))
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(sessions)
+}
+
+// DeleteAccountSession ends the browser session of the user, ending the current session logs out
+func DeleteAccountSession(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.BadRequest("Invalid session id")
+	}
+
+	if current := sessionOf(c); current != nil && current.ID == id {
+		if err = endSession(c); err != nil {
+			return c.InternalServerError(err.Error())
+		}
+		return c.NoContent()
+	}
+
+	n, err := client.Session.Delete().
+		Where(session.IDEQ(id)).
+		Where(session.HasUserWith(user.IDEQ(_user.ID))).
+		Exec(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+	if 0 == n {
+		return c.NotFound("Session not found")
+	}
+
+	return c.NoContent()
+}
+
+// GetAccountProfile returns the profile of the user
+func GetAccountProfile(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	return c.Ok(_user)
+}
+
+// PatchAccountProfile updates the fields of the profile present in the request, an empty field is cleared
+func PatchAccountProfile(c *Context) error {
+	var form struct {
+		Name      *string `json:"name"`
+		AvatarURL *string `json:"avatar_url" note:"http or https URL of the avatar picture"`
+		Locale    *string `json:"locale" note:"BCP 47 language tag, such as en or zh-CN"`
+		Timezone  *string `json:"timezone" note:"IANA time zone, such as Asia/Shanghai"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	updater := _user.Update()
+	if form.Name != nil {
+		if "" == *form.Name {
+			updater.ClearName()
+		} else {
+			updater.SetName(*form.Name)
+		}
+	}
+	if form.AvatarURL != nil {
+		if "" == *form.AvatarURL {
+			updater.ClearAvatarURL()
+		} else if u, err := url.Parse(*form.AvatarURL); err != nil || ("http" != u.Scheme && "https" != u.Scheme) || "" == u.Host {
+			return c.BadRequest("Invalid avatar_url: %v", *form.AvatarURL)
+		} else {
+			updater.SetAvatarURL(*form.AvatarURL)
+		}
+	}
+	if form.Locale != nil {
+		if "" == *form.Locale {
+			updater.ClearLocale()
+		} else if !localeTag.MatchString(*form.Locale) {
+			return c.BadRequest("Invalid locale: %v", *form.Locale)
+		} else {
+			updater.SetLocale(*form.Locale)
+		}
+	}
+	if form.Timezone != nil {
+		if "" == *form.Timezone {
+			updater.ClearTimezone()
+		} else if _, err := time.LoadLocation(*form.Timezone); err != nil || "Local" == *form.Timezone {
+			return c.BadRequest("Invalid timezone: %v", *form.Timezone)
+		} else {
+			updater.SetTimezone(*form.Timezone)
+		}
+	}
+
+	_user, err = updater.Save(ctx)
+	if ent.IsValidationError(err) {
+		return c.BadRequest(err.Error())
+	}
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(_user)
+}
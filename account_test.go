@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"whoam.xyz/ent/service"
+)
+
+func TestAccountServices(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("account@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"first.example.com", "second.example.com"} {
+		_, err = client.Service.Create().
+			SetID(id).
+			SetName(id).
+			SetSubject("").
+			SetDomain("https://" + id).
+			SetCloneURI("https://github.com/excing/whoam.git").
+			Save(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two devices of the first service, one of them refreshed
+	_, laptop, err := newOAuthToken(_user.ID, "first.example.com", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = refreshOAuthToken(laptop.MainToken, "first.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, phone, err := newOAuthToken(_user.ID, "first.example.com", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveGrant(_user.ID, "first.example.com", []string{"openid"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = newOAuthToken(_user.ID, "second.example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = newOAuthToken(_user.ID, MainServiceID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := accountServicesOf(_user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 2 != len(services) || "first.example.com" != services[0].ID || "second.example.com" != services[1].ID {
+		t.Fatal("the authorized services should be listed, except whoam itself", services)
+	}
+	if 2 != len(services[0].Sessions) || 1 != len(services[0].Scopes) {
+		t.Error("the active families of the service should be grouped", services[0].Sessions)
+	}
+
+	if err = revokeFamily(phone); err != nil {
+		t.Fatal(err)
+	}
+	services, _ = accountServicesOf(_user.ID)
+	if 1 != len(services[0].Sessions) {
+		t.Error("the revoked family shouldn't be listed", services[0].Sessions)
+	}
+
+	if err = revokeAccountService(_user.ID, "first.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	services, _ = accountServicesOf(_user.ID)
+	if 1 != len(services) || "second.example.com" != services[0].ID {
+		t.Error("the revoked service shouldn't be listed", services)
+	}
+	if isGranted(_user.ID, "first.example.com", []string{"openid"}) {
+		t.Error("the grant of the revoked service should be deleted")
+	}
+	if _, _, err = refreshOAuthToken(laptop.MainToken, "first.example.com"); err != errInvalidRefreshToken {
+		t.Error("the refresh tokens of the revoked service should be revoked", err)
+	}
+	if _, err = client.Service.Query().Where(service.IDEQ("first.example.com")).Only(ctx); err != nil {
+		t.Error("revoking the access shouldn't delete the service", err)
+	}
+}
+
+func TestAccountSessions(t *testing.T) {
+	setupOAuth(t)
+
+	current, cookie := loginSession(t, "sessions@example.com")
+	userID := current.QueryUser().OnlyIDX(ctx)
+
+	c, _ := newSessionContext("POST")
+	_, err := newSession(c, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ = newSessionContext("GET", cookie)
+	sessions, err := accountSessionsOf(userID, sessionOf(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 2 != len(sessions) {
+		t.Fatal("the sessions of the user should be listed", sessions)
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == current.ID) {
+			t.Error("only the session of the request is current", s)
+		}
+	}
+
+	if err = endUserSessions(userID); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ = accountSessionsOf(userID, nil); 0 != len(sessions) {
+		t.Error("all sessions of the user should be ended", sessions)
+	}
+}
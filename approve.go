@@ -0,0 +1,210 @@
+// Magic link login: the email carries a signed link, the user approves the login from the link,
+// and the waiting client polls the result with the verification token.
+
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const audienceApproval = "urn:whoam:approval"    // the audience of the approval tokens in magic links
+const typeApproval = "whoam-approval+jwt"        // the `typ` header of the approval tokens, they aren't access tokens
+const timeoutLoginPoll = 25 * time.Second        // a status request waits for the approval at most: 25s
+const intervalLoginPoll = 500 * time.Millisecond // interval to check the approval while waiting: 500ms
+const maxLoginPolls = 60                         // status requests of a verification token: 60, the client polls about 36 times
+
+var errInvalidApproval = errors.New("The link is invalid or has expired")
+
+// newApprovalLink returns the magic link which approves the login of the verification token.
+// The link carries a signed approval token, its ID refers to the verification token and can only be used once.
+func newApprovalLink(token string, email string) (string, error) {
+	approvalID := New64BitID()
+	if err := userVerificaBox.SetStringVal("approval:"+approvalID, token); err != nil {
+		return "", err
+	}
+
+	key := jwtKeys.SigningKey()
+	now := time.Now()
+	jwtToken := jwt.NewWithClaims(key.Method, &StandardClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        approvalID,
+			Issuer:    issuer(),
+			Subject:   email,
+			Audience:  audienceApproval,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(timeoutUserVerification * time.Second).Unix(),
+		},
+	})
+	jwtToken.Header["kid"] = key.ID
+	jwtToken.Header["typ"] = typeApproval
+
+	signed, err := jwtToken.SignedString(key.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return issuer() + "/user/approve?" + url.Values{"token": {signed}}.Encode(), nil
+}
+
+// parseApprovalToken verifies the approval token of a magic link
+func parseApprovalToken(approvalToken string) (*StandardClaims, error) {
+	claims := &StandardClaims{}
+	if err := parseJWT(approvalToken, jwtKeys, typeApproval, claims); err != nil || claims.Audience != audienceApproval {
+		return nil, errInvalidApproval
+	}
+	return claims, nil
+}
+
+// approveLogin approves the login of the magic link, the link can't be used again.
+// The approval is kept beside the verification token until it expires, the token itself isn't changed,
+// so that the waiting status request or the login with the code isn't interrupted.
+func approveLogin(approvalToken string) error {
+	claims, err := parseApprovalToken(approvalToken)
+	if err != nil {
+		return err
+	}
+
+	token, err := userVerificaBox.Take("approval:" + claims.Id)
+	if err != nil {
+		return errInvalidApproval
+	}
+
+	var form userVerificationForm
+	if err = userVerificaBox.Val(string(token), &form); err != nil || form.Email != claims.Subject {
+		return errInvalidApproval
+	}
+
+	// The approval token expires with the verification token
+	timeout := claims.ExpiresAt - time.Now().Unix()
+	if timeout <= 0 {
+		return errInvalidApproval
+	}
+	return userVerificaBox.SetBoolVal("approved:"+string(token), true, int(timeout))
+}
+
+// pendingLoginOf returns the login which the approval token approves, the login isn't changed
+func pendingLoginOf(claims *StandardClaims) (*userVerificationForm, error) {
+	token, err := userVerificaBox.StringVal("approval:" + claims.Id)
+	if err != nil {
+		return nil, errInvalidApproval
+	}
+
+	var form userVerificationForm
+	if err = userVerificaBox.Val(token, &form); err != nil || form.Email != claims.Subject {
+		return nil, errInvalidApproval
+	}
+	return &form, nil
+}
+
+// approveEndpoint the page of the magic link, the user confirms the login on it.
+// The link doesn't approve the login by itself, so that it isn't approved by mail scanners which open links.
+// The page shows the client which requested the login and its matching code, which is also shown on the login page.
+func approveEndpoint(c *Context) error {
+	var response struct {
+		Email     string
+		Token     string
+		Error     string
+		IP        string
+		UserAgent string
+		Time      string
+		MatchCode string
+	}
+
+	response.Token = c.Query("token")
+	claims, err := parseApprovalToken(response.Token)
+	var form *userVerificationForm
+	if err == nil {
+		form, err = pendingLoginOf(claims)
+	}
+	if err != nil {
+		response.Error = c.T(err.Error())
+		return c.OkHTML(tlpUserApprove, &response)
+	}
+
+	response.Email = claims.Subject
+	if form.Request != nil {
+		response.IP = form.Request.IP
+		response.UserAgent = form.Request.UserAgent
+		response.Time = time.Unix(form.Request.Time, 0).UTC().Format("2006-01-02 15:04:05 UTC")
+		response.MatchCode = form.Request.MatchCode
+	}
+
+	return c.OkHTML(tlpUserApprove, &response)
+}
+
+// PostMainApprove approves the login with the approval token of the magic link
+func PostMainApprove(c *Context) error {
+	var _body struct {
+		Token string `json:"token" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&_body)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	if err = approveLogin(_body.Token); err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// PostMainStatus waits for the approval of the magic link, it's a long polling request.
+// If the login is approved, the user is logged in, and the tokens are returned;
+// if it isn't approved within timeoutLoginPoll, NoContent is returned and the client should request again.
+func PostMainStatus(c *Context) error {
+	var dst struct {
+		Email string `json:"email" binding:"required"`
+		State string `json:"state" binding:"required"`
+		Token string `json:"token" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&dst)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	if ok, retry := pollRateLimiter.Allow(dst.Token); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		return c.TooManyRequests("Too many status requests, please log in again")
+	}
+
+	deadline := time.Now().Add(timeoutLoginPoll)
+	for {
+		var src userVerificationForm
+		if err = userVerificaBox.Val(dst.Token, &src); err != nil {
+			return c.Unauthorized("Verification failed: token is invalid or code is expired")
+		}
+
+		if !equalString(src.Token, dst.Token) || src.State != dst.State || src.Email != dst.Email {
+			failVerification(dst.Token)
+			return c.Unauthorized("Verification failed: token is invalid")
+		}
+
+		if approved, _ := userVerificaBox.BoolVal("approved:" + dst.Token); approved {
+			// The verification token is single-use, only one of the concurrent requests takes it
+			if _, err = userVerificaBox.Take(dst.Token); err != nil {
+				return c.Unauthorized("Verification failed: token is invalid or code is expired")
+			}
+			userVerificaBox.DelString("attempts:" + dst.Token)
+			userVerificaBox.DelString("approved:" + dst.Token)
+
+			return loginMain(c, src.Email)
+		}
+
+		if time.Now().After(deadline) {
+			return c.NoContent()
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return nil
+		case <-time.After(intervalLoginPoll):
+		}
+	}
+}
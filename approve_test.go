@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// newTestApproval returns the verification token and the approval token of its magic link
+func newTestApproval(t *testing.T, email string, request ...*loginRequest) (string, string) {
+	token := New64BitID()
+	form := userVerificationForm{Email: email, State: "state", Code: "CODE", Token: token}
+	if 0 < len(request) {
+		form.Request = request[0]
+	}
+	if err := userVerificaBox.SetVal(token, form); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := newApprovalLink(token, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, u.Query().Get("token")
+}
+
+func TestApproveLogin(t *testing.T) {
+	setupOAuth(t)
+
+	token, approvalToken := newTestApproval(t, "approve@example.com")
+
+	if err := approveLogin(approvalToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if approved, err := userVerificaBox.BoolVal("approved:" + token); err != nil || !approved {
+		t.Error("the login should be approved", err)
+	}
+
+	var form userVerificationForm
+	if err := userVerificaBox.Val(token, &form); err != nil || "CODE" != form.Code {
+		t.Error("the verification token should be kept for the login", form, err)
+	}
+
+	if err := approveLogin(approvalToken); err != errInvalidApproval {
+		t.Error("the magic link should be single-use", err)
+	}
+
+	if _, err := FilterJWTToken(approvalToken, jwtKeys); err == nil {
+		t.Error("the approval token shouldn't be accepted as an access token")
+	}
+}
+
+func TestApproveLoginInvalidToken(t *testing.T) {
+	setupOAuth(t)
+
+	token, _ := newTestApproval(t, "invalid@example.com")
+
+	key := jwtKeys.SigningKey()
+	claims := &StandardClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        New64BitID(),
+			Subject:   "invalid@example.com",
+			Audience:  MainServiceID,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	}
+	jwtToken := jwt.NewWithClaims(key.Method, claims)
+	jwtToken.Header["kid"] = key.ID
+	jwtToken.Header["typ"] = typeApproval
+	signed, err := jwtToken.SignedString(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = approveLogin(signed); err != errInvalidApproval {
+		t.Error("a token of another audience should be rejected", err)
+	}
+	if err = approveLogin("not.a.token"); err != errInvalidApproval {
+		t.Error("a malformed token should be rejected", err)
+	}
+
+	accessToken, err := NewJWTToken(0, exampleService, "", "", time.Minute, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = approveLogin(accessToken); err != errInvalidApproval {
+		t.Error("an access token should be rejected", err)
+	}
+
+	if approved, _ := userVerificaBox.BoolVal("approved:" + token); approved {
+		t.Error("the login shouldn't be approved")
+	}
+}
+
+func TestApproveLoginOfAnotherEmail(t *testing.T) {
+	setupOAuth(t)
+
+	token, _ := newTestApproval(t, "victim@example.com")
+
+	link, err := newApprovalLink(token, "attacker@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(link)
+
+	if err = approveLogin(u.Query().Get("token")); err != errInvalidApproval {
+		t.Error("the approval of another email should be rejected", err)
+	}
+}
+
+func TestApproveEndpoint(t *testing.T) {
+	setupOAuth(t)
+	InitI18n()
+
+	requestedAt := time.Date(2020, 10, 1, 8, 30, 0, 0, time.UTC)
+	_, approvalToken := newTestApproval(t, "page@example.com", &loginRequest{
+		IP:        "203.0.113.7",
+		UserAgent: "Mozilla/5.0 <script>",
+		Time:      requestedAt.Unix(),
+		MatchCode: "42",
+	})
+
+	// renderApprove renders the page of the magic link with the approval token
+	renderApprove := func(approvalToken string) string {
+		c, w := newSessionContext("GET")
+		c.Request.URL.RawQuery = url.Values{"token": {approvalToken}}.Encode()
+		if err := approveEndpoint(c); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+
+	page := renderApprove(approvalToken)
+	for _, want := range []string{"page@example.com", "203.0.113.7", "2020-10-01 08:30:00 UTC", "<b>42</b>", "Mozilla/5.0 &lt;script&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Error("the page should show the requester of the login", want)
+		}
+	}
+
+	// The page doesn't approve the login, and the link can be still approved
+	if err := approveLogin(approvalToken); err != nil {
+		t.Error("the page shouldn't use the magic link", err)
+	}
+
+	if page = renderApprove(approvalToken); strings.Contains(page, "203.0.113.7") || strings.Contains(page, "<b>42</b>") {
+		t.Error("the used link shouldn't show the requester")
+	}
+}
@@ -4,24 +4,56 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"math"
-
-	"github.com/coocood/freecache"
+	"strconv"
 )
 
-// Box a freecache inheritance structure
+// Box typed values of a KVStore, the keys are prefixed to share the store with other boxes
 type Box struct {
-	freecache.Cache
+	store          KVStore
+	prefix         string
 	defaultTimeout int
 }
 
-// NewBox return new box
+// NewBox return new box of a memory store
 func NewBox(size int, defaultTimeout int) *Box {
-	return &Box{*freecache.NewCache(size), defaultTimeout}
+	return NewStoreBox(NewMemoryStore(size), "", defaultTimeout)
+}
+
+// NewStoreBox return new box of the store, all keys are prefixed by the prefix
+func NewStoreBox(store KVStore, prefix string, defaultTimeout int) *Box {
+	return &Box{store, prefix, defaultTimeout}
+}
+
+// Take return the bytes value and delete the key atomically,
+// only one of the concurrent takers gets the value.
+func (box *Box) Take(key string) ([]byte, error) {
+	return box.store.GetAndDelete(box.prefix + key)
+}
+
+// TakeVal parse the value of the key into dst, and delete the key atomically
+func (box *Box) TakeVal(key string, dst interface{}) error {
+	bytes, err := box.Take(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, &dst)
+}
+
+// Incr increments the counter of the key atomically and returns it,
+// the counter expires in the timeout since the first increment.
+func (box *Box) Incr(key string, timeout ...int) (int, error) {
+	ttl := box.defaultTimeout
+	if 0 < len(timeout) {
+		ttl = timeout[0]
+	}
+
+	n, err := box.store.Incr(box.prefix+key, ttl)
+	return int(n), err
 }
 
 // DelString return true, if delete the key fails, return false
 func (box *Box) DelString(key string) bool {
-	return box.Del([]byte(key))
+	return nil == box.store.Delete(box.prefix+key)
 }
 
 // SetVal set key-value
@@ -32,12 +64,12 @@ func (box *Box) SetVal(key string, val interface{}, timeout ...int) error {
 		return err
 	}
 
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // Val parse the value of the key into dst
 func (box *Box) Val(key string, dst interface{}) error {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return err
 	}
@@ -54,12 +86,12 @@ func (box *Box) SetValI(key int, val interface{}, timeout ...int) error {
 		return err
 	}
 
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // ValI parse the value of the int key into dst
 func (box *Box) ValI(key int, dst interface{}) error {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return err
 	}
@@ -70,12 +102,12 @@ func (box *Box) ValI(key int, dst interface{}) error {
 
 // SetStringVal set key-string value
 func (box *Box) SetStringVal(key string, val string, timeout ...int) error {
-	return box.setVal([]byte(key), []byte(val), timeout...)
+	return box.setVal(key, []byte(val), timeout...)
 }
 
 // StringVal return string value
 func (box *Box) StringVal(key string) (string, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return "", err
 	}
@@ -84,12 +116,12 @@ func (box *Box) StringVal(key string) (string, error) {
 
 // SetStringValI set int key-string value
 func (box *Box) SetStringValI(key int, val string, timeout ...int) error {
-	return box.setVal(IntToBytes(key), []byte(val), timeout...)
+	return box.setVal(intKey(key), []byte(val), timeout...)
 }
 
 // StringValI return string value
 func (box *Box) StringValI(key int) (string, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return "", err
 	}
@@ -100,12 +132,12 @@ func (box *Box) StringValI(key int) (string, error) {
 func (box *Box) SetByteVal(key string, val byte, timeout ...int) error {
 	bytes := make([]byte, 1)
 	bytes[0] = val
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // ByteVal return byte value
 func (box *Box) ByteVal(key string) (byte, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return 0, err
 	}
@@ -117,12 +149,12 @@ func (box *Box) ByteVal(key string) (byte, error) {
 func (box *Box) SetByteValI(key int, val byte, timeout ...int) error {
 	bytes := make([]byte, 1)
 	bytes[0] = val
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // ByteValI return byte value
 func (box *Box) ByteValI(key int) (byte, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return 0, err
 	}
@@ -134,12 +166,12 @@ func (box *Box) ByteValI(key int) (byte, error) {
 func (box *Box) SetUint64Val(key string, val uint64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], val)
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // Uint64Val return uint64 value
 func (box *Box) Uint64Val(key string) (uint64, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return 0, err
 	}
@@ -153,12 +185,12 @@ func (box *Box) Uint64Val(key string) (uint64, error) {
 func (box *Box) SetUint64ValI(key int, val uint64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], val)
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // Uint64ValI return uint64 value
 func (box *Box) Uint64ValI(key int) (uint64, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return 0, err
 	}
@@ -172,12 +204,12 @@ func (box *Box) Uint64ValI(key int) (uint64, error) {
 func (box *Box) SetInt64Val(key string, val int64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], uint64(val))
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // Int64Val return int64 value
 func (box *Box) Int64Val(key string) (int64, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return 0, err
 	}
@@ -202,12 +234,12 @@ func (box *Box) IntVal(key string) (int, error) {
 func (box *Box) SetInt64ValI(key int, val int64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], uint64(val))
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // Int64ValI return int64 value
 func (box *Box) Int64ValI(key int) (int64, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return 0, err
 	}
@@ -232,12 +264,12 @@ func (box *Box) IntValI(key int) (int, error) {
 func (box *Box) SetFloat64Val(key string, val float64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], math.Float64bits(val))
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // Float64Val return float64 value
 func (box *Box) Float64Val(key string) (float64, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return 0, err
 	}
@@ -251,12 +283,12 @@ func (box *Box) Float64Val(key string) (float64, error) {
 func (box *Box) SetFloat64ValI(key int, val float64, timeout ...int) error {
 	bytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(bytes[:], math.Float64bits(val))
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // Float64ValI return float64 value
 func (box *Box) Float64ValI(key int) (float64, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return 0, err
 	}
@@ -274,12 +306,12 @@ func (box *Box) SetBoolVal(key string, val bool, timeout ...int) error {
 	} else {
 		bytes[0] = 0
 	}
-	return box.setVal([]byte(key), bytes, timeout...)
+	return box.setVal(key, bytes, timeout...)
 }
 
 // BoolVal return bool value
 func (box *Box) BoolVal(key string) (bool, error) {
-	bytes, err := box.Get([]byte(key))
+	bytes, err := box.get(key)
 	if err != nil {
 		return false, err
 	}
@@ -297,12 +329,12 @@ func (box *Box) SetBoolValI(key int, val bool, timeout ...int) error {
 	} else {
 		bytes[0] = 0
 	}
-	return box.setVal(IntToBytes(key), bytes, timeout...)
+	return box.setVal(intKey(key), bytes, timeout...)
 }
 
 // BoolValI return bool value
 func (box *Box) BoolValI(key int) (bool, error) {
-	bytes, err := box.Get(IntToBytes(key))
+	bytes, err := box.get(intKey(key))
 	if err != nil {
 		return false, err
 	}
@@ -312,12 +344,21 @@ func (box *Box) BoolValI(key int) (bool, error) {
 	return x, nil
 }
 
-func (box *Box) setVal(key []byte, val []byte, timeout ...int) error {
+func (box *Box) setVal(key string, val []byte, timeout ...int) error {
 	if 0 == len(timeout) {
-		return box.Set([]byte(key), val, box.defaultTimeout)
+		return box.store.Set(box.prefix+key, val, box.defaultTimeout)
 	}
 
-	return box.Set([]byte(key), val, timeout[0])
+	return box.store.Set(box.prefix+key, val, timeout[0])
+}
+
+func (box *Box) get(key string) ([]byte, error) {
+	return box.store.Get(box.prefix + key)
+}
+
+// intKey return the string key of the int key, distinguished from string keys
+func intKey(i int) string {
+	return "#" + strconv.Itoa(i)
 }
 
 // IntToBytes return bytes from int
@@ -74,6 +74,20 @@ func (p *Context) GetFormString(key string) (string, error) {
 	return "", errors.Errorf("The form is missing the '%v' parameter", key)
 }
 
+// Page returns the offset and limit query of a paginated list,
+// the limit is 20 by default and at most 100.
+func (p *Context) Page() (int, int) {
+	offset, _ := strconv.Atoi(p.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(p.DefaultQuery("limit", "20"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || 100 < limit {
+		limit = 20
+	}
+	return offset, limit
+}
+
 // Render writes the response headers and calls render.Render to render data.
 func (p *Context) Render(code int, r render.Render) error {
 	p.Status(code)
@@ -114,13 +128,13 @@ func (p *Context) Found(location string) error {
 // BadRequest writes a BadRequest code(400) with the given string into the response body.
 // Bad input parameter. Error message should indicate which one and why.
 func (p *Context) BadRequest(format string, values ...interface{}) error {
-	return p.Render(http.StatusBadRequest, render.String{Format: format, Data: values})
+	return p.Render(http.StatusBadRequest, render.String{Format: p.T(format), Data: values})
 }
 
 // Unauthorized writes a Unauthorized request code(401) request with the given string into the response body.
 // The client passed in the invalid Auth token. Client should refresh the token and then try again.
 func (p *Context) Unauthorized(format string, values ...interface{}) error {
-	return p.Render(http.StatusUnauthorized, render.String{Format: format, Data: values})
+	return p.Render(http.StatusUnauthorized, render.String{Format: p.T(format), Data: values})
 }
 
 // Forbidden writes a Forbidden request code(403) with the given string into the response body.
@@ -132,55 +146,60 @@ func (p *Context) Unauthorized(format string, values ...interface{}) error {
 // * Operation is blocked (for third-party apps).
 // * Customer account over quota.
 func (p *Context) Forbidden(format string, values ...interface{}) error {
-	return p.Render(http.StatusForbidden, render.String{Format: format, Data: values})
+	return p.Render(http.StatusForbidden, render.String{Format: p.T(format), Data: values})
 }
 
 // NotFound writes a NotFound request code(404) with the given string into the response body.
 // Resource not found.
 func (p *Context) NotFound(format string, values ...interface{}) error {
-	return p.Render(http.StatusNotFound, render.String{Format: format, Data: values})
+	return p.Render(http.StatusNotFound, render.String{Format: p.T(format), Data: values})
 }
 
 // MethodNotAllowed writes a MethodNotAllowed request code(405) with the given string into the response body.
 // The resource doesn't support the specified HTTP verb.
 func (p *Context) MethodNotAllowed(format string, values ...interface{}) error {
-	return p.Render(http.StatusMethodNotAllowed, render.String{Format: format, Data: values})
+	return p.Render(http.StatusMethodNotAllowed, render.String{Format: p.T(format), Data: values})
 }
 
 // Conflict writes a Conflict request code(409) with the given string into the response body.
 // Conflict
 func (p *Context) Conflict(format string, values ...interface{}) error {
-	return p.Render(http.StatusConflict, render.String{Format: format, Data: values})
+	return p.Render(http.StatusConflict, render.String{Format: p.T(format), Data: values})
 }
 
 // LengthRequired writes a LengthRequired request code(411) with the given string into the response body.
 // The Content-Length header was not specified.
 func (p *Context) LengthRequired(format string, values ...interface{}) error {
-	return p.Render(http.StatusLengthRequired, render.String{Format: format, Data: values})
+	return p.Render(http.StatusLengthRequired, render.String{Format: p.T(format), Data: values})
 }
 
 // PreconditionFailed writes a PreconditionFailed request code(412) with the given string into the response body.
 // Precondition failed.
 func (p *Context) PreconditionFailed(format string, values ...interface{}) error {
-	return p.Render(http.StatusPreconditionFailed, render.String{Format: format, Data: values})
+	return p.Render(http.StatusPreconditionFailed, render.String{Format: p.T(format), Data: values})
 }
 
 // TooManyRequests writes a TooManyRequests request code(429) with the given string into the response body.
 // Too many request for rate limiting.
 func (p *Context) TooManyRequests(format string, values ...interface{}) error {
-	return p.Render(http.StatusTooManyRequests, render.String{Format: format, Data: values})
+	return p.Render(http.StatusTooManyRequests, render.String{Format: p.T(format), Data: values})
 }
 
 // InternalServerError writes a InternalServerError request code(500) with the given string into the response body.
 // Servers are not working as expected. The request is probably valid but needs to be requested again later.
 func (p *Context) InternalServerError(format string, values ...interface{}) error {
-	return p.Render(http.StatusInternalServerError, render.String{Format: format, Data: values})
+	return p.Render(http.StatusInternalServerError, render.String{Format: p.T(format), Data: values})
 }
 
 // ServiceUnavailable writes a ServiceUnavailable request code(503) with the given string into the response body.
 // Service Unavailable.
 func (p *Context) ServiceUnavailable(format string, values ...interface{}) error {
-	return p.Render(http.StatusServiceUnavailable, render.String{Format: format, Data: values})
+	return p.Render(http.StatusServiceUnavailable, render.String{Format: p.T(format), Data: values})
+}
+
+// OAuthError writes the OAuth 2.0 error(RFC 6749 §5.2) as JSON into the response body.
+func (p *Context) OAuthError(e *oauthError) error {
+	return p.Render(e.Status, render.JSON{Data: e})
 }
 
 // Ok serializes the given struct as JSON into the response body.
@@ -196,14 +215,17 @@ func (p *Context) Ok(obj interface{}) error {
 // It also updates the HTTP code and sets the Content-Type as "text/html".
 // See http://golang.org/doc/articles/wiki/
 func (p *Context) OkHTML(name string, obj interface{}) error {
-	p.HTML(http.StatusOK, name, obj)
-	return nil
+	tmpl, ok := templates[p.Locale()]
+	if !ok {
+		tmpl = templates[config.Locale]
+	}
+	return p.Render(http.StatusOK, render.HTML{Template: tmpl, Name: name, Data: obj})
 }
 
 // Created writes a Created request code(201) with the given string into the response body.
 // Indicates that request has succeeded and a new resource has been created as a result.
 func (p *Context) Created(format string, values ...interface{}) error {
-	return p.Render(http.StatusCreated, render.String{Format: format, Data: values})
+	return p.Render(http.StatusCreated, render.String{Format: p.T(format), Data: values})
 }
 
 // NoContent writes a NoContent request code(204) with the given string into the response body.
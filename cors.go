@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent/service"
+)
+
+const intervalOriginsReload = time.Minute // reload the origins of the verified services: 1min
+const maxAgeCORSPreflight = 600           // browsers cache the preflight response: 10min
+
+const corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+const corsAllowHeaders = "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, ResponseType, accept, origin, Cache-Control, X-Requested-With"
+
+// CORSPolicy is the CORS policy of a route group.
+// The Origin of the request is echoed only if it's allowed, otherwise there is no CORS header.
+type CORSPolicy struct {
+	AllowAll         bool                     // Any origin is allowed without credentials, the Origin isn't echoed
+	AllowOrigin      func(origin string) bool // Reports whether the origin is allowed, if not AllowAll
+	AllowCredentials bool                     // Whether the cookies are allowed
+}
+
+// openCORS is the policy of the public resources, such as the discovery document and JWKS
+var openCORS = &CORSPolicy{AllowAll: true}
+
+// restrictedCORS is the policy of the APIs of the web UI, which use the session cookie,
+// only config.AllowedOrigins are allowed.
+var restrictedCORS = &CORSPolicy{AllowOrigin: configuredOrigin, AllowCredentials: true}
+
+// serviceCORS is the policy of the token, userinfo and legacy OAuth endpoints called by the services, they don't use cookies,
+// the domains of the verified services and config.AllowedOrigins are allowed.
+var serviceCORS = &CORSPolicy{AllowOrigin: allowedOrigin}
+
+// Apply sets the policy to the routes of the group, and handles the preflight requests of them
+func (p *CORSPolicy) Apply(group *gin.RouterGroup) {
+	group.Use(p.Handle)
+	group.OPTIONS("", p.Handle)
+	group.OPTIONS("/*path", p.Handle)
+}
+
+// Route adds the route of the group with the policy, and handles its preflight requests.
+// It's used if the routes of the group have different policies, then the group itself has no policy.
+func (p *CORSPolicy) Route(group *gin.RouterGroup, method string, relativePath string, handlers ...gin.HandlerFunc) {
+	group.Handle(method, relativePath, append([]gin.HandlerFunc{p.Handle}, handlers...)...)
+	group.OPTIONS(relativePath, p.Handle)
+}
+
+// Handle writes the CORS headers of the request, and responds the preflight request
+func (p *CORSPolicy) Handle(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	header := c.Writer.Header()
+
+	allowed := false
+	if p.AllowAll {
+		header.Set("Access-Control-Allow-Origin", "*")
+		allowed = true
+	} else {
+		header.Add("Vary", "Origin")
+		if "" != origin && p.AllowOrigin(origin) {
+			header.Set("Access-Control-Allow-Origin", origin)
+			if p.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			allowed = true
+		}
+	}
+
+	if http.MethodOptions == c.Request.Method {
+		if allowed {
+			header.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			header.Set("Access-Control-Max-Age", strconv.Itoa(maxAgeCORSPreflight))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.Next()
+}
+
+// originOf returns the origin of the URL, such as https://example.com for https://example.com/app
+func originOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || "" == u.Scheme || "" == u.Host {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// serviceOrigins caches the origins of the verified services
+var serviceOrigins struct {
+	sync.Mutex
+	origins  map[string]bool
+	loadedAt time.Time
+}
+
+// configuredOrigin reports whether the origin is one of config.AllowedOrigins
+func configuredOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range strings.Split(config.AllowedOrigins, ",") {
+		if "" != strings.TrimSpace(allowed) && originOf(strings.TrimSpace(allowed)) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedOrigin reports whether the origin is one of config.AllowedOrigins or a domain of the verified services
+func allowedOrigin(origin string) bool {
+	if configuredOrigin(origin) {
+		return true
+	}
+	origin = strings.ToLower(origin)
+
+	serviceOrigins.Lock()
+	defer serviceOrigins.Unlock()
+
+	if serviceOrigins.origins == nil || time.Since(serviceOrigins.loadedAt) > intervalOriginsReload {
+		domains, err := client.Service.Query().
+			Where(service.StatusEQ(service.StatusVerified)).
+			Select(service.FieldDomain).
+			Strings(ctx)
+		if err != nil {
+			return serviceOrigins.origins[origin]
+		}
+
+		serviceOrigins.origins = make(map[string]bool)
+		for _, domain := range domains {
+			if o := originOf(domain); "" != o {
+				serviceOrigins.origins[o] = true
+			}
+		}
+		serviceOrigins.loadedAt = time.Now()
+	}
+
+	return serviceOrigins.origins[origin]
+}
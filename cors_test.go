@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent/service"
+)
+
+func newCORSRouter() *gin.Engine {
+	r := gin.New()
+
+	open := r.Group("/.well-known")
+	openCORS.Apply(open)
+	open.GET("/jwks.json", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	restricted := r.Group("/api/v1/user/main")
+	restrictedCORS.Apply(restricted)
+	restricted.POST("/code", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	token := r.Group("/oauth")
+	serviceCORS.Apply(token)
+	token.POST("/token", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	legacy := r.Group("/api/v1/user/oauth")
+	restrictedCORS.Route(legacy, "POST", "/auth", func(c *gin.Context) { c.Status(http.StatusOK) })
+	serviceCORS.Route(legacy, "GET", "/base", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	return r
+}
+
+func serveCORS(r *gin.Engine, method string, path string, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if "" != origin {
+		req.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestOpenCORS(t *testing.T) {
+	r := newCORSRouter()
+
+	w := serveCORS(r, "GET", "/.well-known/jwks.json", "https://any.example.com")
+	if "*" != w.Header().Get("Access-Control-Allow-Origin") || "" != w.Header().Get("Access-Control-Allow-Credentials") {
+		t.Error("any origin should be allowed without credentials", w.Header())
+	}
+
+	w = serveCORS(r, "OPTIONS", "/.well-known/jwks.json", "https://any.example.com")
+	if http.StatusNoContent != w.Code || "" == w.Header().Get("Access-Control-Allow-Methods") {
+		t.Error("the preflight request should be allowed", w.Code, w.Header())
+	}
+}
+
+func TestRestrictedCORS(t *testing.T) {
+	setupOAuth(t)
+
+	allowedOrigins := config.AllowedOrigins
+	defer func() { config.AllowedOrigins = allowedOrigins }()
+	config.AllowedOrigins = "http://localhost:5500, https://admin.example.com/"
+
+	_, err := client.Service.Create().
+		SetID("cors.example.com").
+		SetName("cors").
+		SetSubject("").
+		SetDomain("https://cors.example.com/app").
+		SetCloneURI("https://github.com/excing/whoam.git").
+		SetStatus(service.StatusVerified).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Service.Create().
+		SetID("unverified.example.com").
+		SetName("unverified").
+		SetSubject("").
+		SetDomain("https://unverified.example.com").
+		SetCloneURI("https://github.com/excing/whoam.git").
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceOrigins.origins = nil
+
+	r := newCORSRouter()
+	for _, origin := range []string{"http://localhost:5500", "https://admin.example.com"} {
+		w := serveCORS(r, "POST", "/api/v1/user/main/code", origin)
+		if origin != w.Header().Get("Access-Control-Allow-Origin") || "true" != w.Header().Get("Access-Control-Allow-Credentials") {
+			t.Error("the origin should be echoed", origin, w.Header())
+		}
+
+		w = serveCORS(r, "OPTIONS", "/api/v1/user/main/code", origin)
+		if http.StatusNoContent != w.Code || origin != w.Header().Get("Access-Control-Allow-Origin") {
+			t.Error("the preflight request of the origin should be allowed", origin, w.Code, w.Header())
+		}
+	}
+
+	// The services can't use the session cookie of the user
+	for _, origin := range []string{"https://evil.example.com", "https://unverified.example.com", "http://cors.example.com", "https://cors.example.com"} {
+		w := serveCORS(r, "OPTIONS", "/api/v1/user/main/code", origin)
+		if "" != w.Header().Get("Access-Control-Allow-Origin") || "" != w.Header().Get("Access-Control-Allow-Methods") {
+			t.Error("the origin shouldn't be allowed", origin, w.Header())
+		}
+	}
+
+	for _, origin := range []string{"https://cors.example.com", "http://localhost:5500"} {
+		w := serveCORS(r, "POST", "/oauth/token", origin)
+		if origin != w.Header().Get("Access-Control-Allow-Origin") || "" != w.Header().Get("Access-Control-Allow-Credentials") {
+			t.Error("the origin should be echoed without credentials", origin, w.Header())
+		}
+	}
+
+	for _, origin := range []string{"https://evil.example.com", "https://unverified.example.com"} {
+		w := serveCORS(r, "OPTIONS", "/oauth/token", origin)
+		if "" != w.Header().Get("Access-Control-Allow-Origin") {
+			t.Error("the origin shouldn't be allowed", origin, w.Header())
+		}
+	}
+
+	// The legacy OAuth APIs of the group have their own policies
+	w := serveCORS(r, "OPTIONS", "/api/v1/user/oauth/base", "https://cors.example.com")
+	if http.StatusNoContent != w.Code || "https://cors.example.com" != w.Header().Get("Access-Control-Allow-Origin") {
+		t.Error("the service should call the legacy OAuth API", w.Code, w.Header())
+	}
+	w = serveCORS(r, "GET", "/api/v1/user/oauth/base", "https://cors.example.com")
+	if http.StatusOK != w.Code || "" != w.Header().Get("Access-Control-Allow-Credentials") {
+		t.Error("the legacy OAuth API should be served without credentials", w.Code, w.Header())
+	}
+	w = serveCORS(r, "OPTIONS", "/api/v1/user/oauth/auth", "https://cors.example.com")
+	if "" != w.Header().Get("Access-Control-Allow-Origin") {
+		t.Error("the service shouldn't call the API of the web UI", w.Header())
+	}
+	w = serveCORS(r, "POST", "/api/v1/user/oauth/auth", "http://localhost:5500")
+	if "true" != w.Header().Get("Access-Control-Allow-Credentials") {
+		t.Error("the web UI should call the API with credentials", w.Header())
+	}
+
+	// Same-origin requests have no CORS headers, but they are served
+	w = serveCORS(r, "POST", "/api/v1/user/main/code", "")
+	if http.StatusOK != w.Code || "" != w.Header().Get("Access-Control-Allow-Origin") {
+		t.Error("requests without Origin should be served", w.Code, w.Header())
+	}
+}
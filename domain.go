@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/service"
+)
+
+const wellKnownVerificationPath = "/.well-known/whoam-verification" // the path of the challenge served by the domain
+const dnsVerificationPrefix = "_whoam-verification."                // the TXT record name of the challenge is prefixed to the host
+const dnsVerificationValue = "whoam-verification="                  // the TXT record value is the prefixed challenge
+const timeoutDomainVerification = 10 * time.Second                  // timeout of fetching the well-known URI or the TXT record: 10s
+const intervalDomainRecheck = 24 * time.Hour                        // verified domains are checked again: 24h
+const maxDomainCheckFailures = 3                                    // a domain is unverified after consecutive failed checks: 3
+
+var errDomainUnverified = errors.New("The domain doesn't serve the verification token")
+var errDomainAddress = errors.New("The domain isn't a public address of port 80 or 443")
+
+// internalNetworks are the private and shared address blocks, which the domain verification doesn't connect to
+var internalNetworks = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// Resolver looks up the DNS TXT records, net.DefaultResolver by default
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// domainResolver resolves the TXT records of the domain verification
+var domainResolver Resolver = net.DefaultResolver
+
+// domainHTTPClient fetches the well-known URI of the domain verification over https, redirects aren't followed.
+// It connects only to the public addresses of port 80 or 443, the address is checked after the host is resolved.
+var domainHTTPClient = &http.Client{
+	Timeout: timeoutDomainVerification,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: timeoutDomainVerification,
+			Control: checkDomainAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: timeoutDomainVerification,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// checkDomainAddress refuses the connections to the loopback, private and link-local addresses, and other ports than 80 and 443,
+// so that the domain verification can't be used to reach the internal network.
+func checkDomainAddress(network string, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if "80" != port && "443" != port {
+		return errDomainAddress
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return errDomainAddress
+	}
+	for _, internal := range internalNetworks {
+		if internal.Contains(ip) {
+			return errDomainAddress
+		}
+	}
+	return nil
+}
+
+// InitDomainVerification checks the verified domains again every intervalDomainRecheck
+func InitDomainVerification() {
+	go func() {
+		for range time.Tick(intervalDomainRecheck) {
+			if err := recheckDomains(); err != nil {
+				log.Println("failed to recheck domains:", err)
+			}
+		}
+	}()
+}
+
+// verificationChallenge returns how the service proves control of its domain with the token
+func verificationChallenge(_service *ent.Service) (map[string]string, error) {
+	u, err := url.Parse(_service.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"status":    string(_service.Status),
+		"token":     _service.VerificationToken,
+		"http_uri":  wellKnownURI(u),
+		"dns_name":  dnsVerificationPrefix + u.Hostname(),
+		"dns_value": dnsVerificationValue + _service.VerificationToken,
+	}, nil
+}
+
+// verifyDomain reports whether the domain of the service serves its verification token,
+// by the well-known URI or the DNS TXT record.
+func verifyDomain(_service *ent.Service) error {
+	if "" == _service.VerificationToken {
+		return errDomainUnverified
+	}
+
+	u, err := url.Parse(_service.Domain)
+	if err != nil {
+		return err
+	}
+
+	if verifyWellKnown(u, _service.VerificationToken) || verifyTXTRecord(u, _service.VerificationToken) {
+		return nil
+	}
+	return errDomainUnverified
+}
+
+// wellKnownURI returns the well-known URI of the domain verification,
+// it's always https, a plain http response could be forged by anyone on the network path.
+func wellKnownURI(u *url.URL) string {
+	return "https://" + u.Host + wellKnownVerificationPath
+}
+
+// verifyWellKnown reports whether the well-known URI of the domain responds with the token
+func verifyWellKnown(u *url.URL, token string) bool {
+	resp, err := domainHTTPClient.Get(wellKnownURI(u))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return err == nil && equalString(strings.TrimSpace(string(body)), token)
+}
+
+// verifyTXTRecord reports whether a TXT record of the domain has the token
+func verifyTXTRecord(u *url.URL, token string) bool {
+	c, cancel := context.WithTimeout(context.Background(), timeoutDomainVerification)
+	defer cancel()
+
+	records, err := domainResolver.LookupTXT(c, dnsVerificationPrefix+u.Hostname())
+	if err != nil {
+		return false
+	}
+
+	for _, record := range records {
+		if equalString(strings.TrimSpace(record), dnsVerificationValue+token) {
+			return true
+		}
+	}
+	return false
+}
+
+// recheckDomains checks the verified domains again,
+// a domain is unverified after maxDomainCheckFailures consecutive failed checks.
+func recheckDomains() error {
+	services, err := client.Service.Query().
+		Where(service.StatusEQ(service.StatusVerified)).
+		Where(service.IDNEQ(MainServiceID)).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, _service := range services {
+		updater := _service.Update().SetCheckedAt(time.Now())
+
+		if err = verifyDomain(_service); err == nil {
+			updater.SetCheckFailures(0)
+		} else if failures := _service.CheckFailures + 1; failures < maxDomainCheckFailures {
+			updater.SetCheckFailures(failures)
+		} else {
+			log.Printf("the domain %v of service %v is unverified: %v", _service.Domain, _service.ID, err)
+			updater.SetStatus(service.StatusUnverified).SetCheckFailures(0).ClearVerifiedAt()
+		}
+
+		if _, err = updater.Save(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetServiceVerification returns the challenge of the domain verification,
+// the token is issued at the first request.
+func GetServiceVerification(c *Context) error {
+	_service, err := managedServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	if "" == _service.VerificationToken {
+		_service, err = _service.Update().SetVerificationToken(New64BitID()).Save(ctx)
+		if err != nil {
+			return c.InternalServerError(err.Error())
+		}
+	}
+
+	challenge, err := verificationChallenge(_service)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	return c.Ok(challenge)
+}
+
+// PostServiceVerification verifies the domain of the service with the challenge
+func PostServiceVerification(c *Context) error {
+	_service, err := managedServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	if err = verifyDomain(_service); err != nil {
+		return c.PreconditionFailed(err.Error())
+	}
+
+	now := time.Now()
+	_, err = _service.Update().
+		SetStatus(service.StatusVerified).
+		SetVerifiedAt(now).
+		SetCheckedAt(now).
+		SetCheckFailures(0).
+		Save(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
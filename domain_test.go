@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/service"
+)
+
+// stubResolver resolves the TXT records of the map
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+// createDomainService creates an unverified service of the domain, with its verification token
+func createDomainService(t *testing.T, id string, domain string) *ent.Service {
+	_service, err := client.Service.Create().
+		SetID(id).
+		SetName(id).
+		SetSubject("").
+		SetDomain(domain).
+		SetCloneURI("https://github.com/excing/whoam.git").
+		SetVerificationToken(New64BitID()).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return _service
+}
+
+func TestVerifyDomainWellKnown(t *testing.T) {
+	setupOAuth(t)
+
+	var token string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wellKnownVerificationPath != r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(token + "\n"))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	// The domain has no TXT record
+	resolver := domainResolver
+	defer func() { domainResolver = resolver }()
+	domainResolver = stubResolver{}
+
+	// The test server is a loopback address with a self-signed certificate, which the client of the domain verification refuses
+	httpClient := domainHTTPClient
+	defer func() { domainHTTPClient = httpClient }()
+	domainHTTPClient = server.Client()
+	domainHTTPClient.CheckRedirect = httpClient.CheckRedirect
+
+	_service := createDomainService(t, "wellknown.example.com", server.URL+"/app")
+
+	token = "wrong"
+	if err := verifyDomain(_service); err != errDomainUnverified {
+		t.Error("a wrong token shouldn't verify the domain", err)
+	}
+
+	token = _service.VerificationToken
+	if err := verifyDomain(_service); err != nil {
+		t.Error("the well-known URI should verify the domain", err)
+	}
+
+	// The well-known URI is only fetched over https, even if the domain is http
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	_service = createDomainService(t, "plain.wellknown.example.com", plain.URL+"/app")
+	token = _service.VerificationToken
+	if err := verifyDomain(_service); err != errDomainUnverified {
+		t.Error("the well-known URI over plain http shouldn't verify the domain", err)
+	}
+}
+
+func TestCheckDomainAddress(t *testing.T) {
+	for _, address := range []string{"93.184.216.34:80", "93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		if err := checkDomainAddress("tcp", address, nil); err != nil {
+			t.Error("the public address should be allowed", address, err)
+		}
+	}
+
+	for _, address := range []string{
+		"93.184.216.34:22", "127.0.0.1:80", "[::1]:443", "10.0.0.1:80", "172.16.0.1:443", "192.168.1.1:80",
+		"169.254.169.254:80", "100.64.0.1:80", "0.0.0.0:80", "[fd00::1]:443", "[fe80::1]:80",
+	} {
+		if err := checkDomainAddress("tcp", address, nil); err != errDomainAddress {
+			t.Error("the internal address should be refused", address, err)
+		}
+	}
+
+	u, _ := url.Parse("http://127.0.0.1:80")
+	if verifyWellKnown(u, "token") {
+		t.Error("the well-known URI of a loopback address shouldn't be fetched")
+	}
+}
+
+func TestVerifyDomainTXTRecord(t *testing.T) {
+	setupOAuth(t)
+
+	resolver := domainResolver
+	defer func() { domainResolver = resolver }()
+
+	_service := createDomainService(t, "txt.example.com", "http://127.0.0.1:1/app")
+
+	domainResolver = stubResolver{"_whoam-verification.127.0.0.1": {"v=spf1 -all"}}
+	if err := verifyDomain(_service); err != errDomainUnverified {
+		t.Error("the domain without the TXT record shouldn't be verified", err)
+	}
+
+	domainResolver = stubResolver{"_whoam-verification.127.0.0.1": {"v=spf1 -all", "whoam-verification=" + _service.VerificationToken}}
+	if err := verifyDomain(_service); err != nil {
+		t.Error("the TXT record should verify the domain", err)
+	}
+}
+
+func TestRecheckDomains(t *testing.T) {
+	setupOAuth(t)
+
+	resolver := domainResolver
+	defer func() { domainResolver = resolver }()
+
+	_service := createDomainService(t, "recheck.example.com", "http://127.0.0.1:1/app")
+	_service, err := _service.Update().SetStatus(service.StatusVerified).Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domainResolver = stubResolver{"_whoam-verification.127.0.0.1": {"whoam-verification=" + _service.VerificationToken}}
+	if err = recheckDomains(); err != nil {
+		t.Fatal(err)
+	}
+
+	domainResolver = stubResolver{}
+	for i := 1; i <= maxDomainCheckFailures; i++ {
+		if err = recheckDomains(); err != nil {
+			t.Fatal(err)
+		}
+
+		_service = client.Service.GetX(ctx, _service.ID)
+		if i < maxDomainCheckFailures && service.StatusVerified != _service.Status {
+			t.Error("the domain should be still verified after failed checks", i)
+		}
+	}
+	if service.StatusUnverified != _service.Status {
+		t.Error("the domain should be unverified after the max failed checks")
+	}
+
+	mainService := client.Service.GetX(ctx, MainServiceID)
+	if service.StatusVerified != mainService.Status {
+		t.Error("the main service should be always verified")
+	}
+}
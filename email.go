@@ -0,0 +1,375 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/email"
+	"whoam.xyz/ent/user"
+)
+
+var errEmailInUse = errors.New("The email is used by another account")
+
+// emailVerification is the code sent to the added address, the key is `email:<id>`
+type emailVerification struct {
+	Code   string `json:"code"`
+	UserID int    `json:"userId"`
+}
+
+// InitEmail adds the primary email record of the users created before emails are records,
+// and fills the verified address of the verified records created before it's kept.
+func InitEmail() {
+	users, err := client.User.Query().Where(user.Not(user.HasEmails())).All(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, _user := range users {
+		_, err = client.Email.Create().
+			SetUser(_user).
+			SetAddress(_user.Email).
+			SetVerified(true).
+			SetVerifiedAt(_user.CreatedAt).
+			SetVerifiedAddress(_user.Email).
+			SetPrimary(true).
+			Save(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	emails, err := client.Email.Query().Where(email.VerifiedEQ(true), email.VerifiedAddressIsNil()).All(ctx)
+	if err != nil {
+		panic(err)
+	}
+	for _, _email := range emails {
+		if err = _email.Update().SetVerifiedAddress(_email.Address).Exec(ctx); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// userOfEmail returns the user of the verified address, the primary email or a verified secondary one
+func userOfEmail(address string) (*ent.User, error) {
+	return client.User.Query().
+		Where(user.Or(
+			user.EmailEQ(address),
+			user.HasEmailsWith(email.AddressEQ(address), email.VerifiedEQ(true)),
+		)).
+		Only(ctx)
+}
+
+// createUser creates the user of the verified address, with its primary email record.
+// The unverified records of the address added by other users are deleted, their owner is proved now.
+func createUser(address string) (*ent.User, error) {
+	var _user *ent.User
+	err := WithTx(ctx, client, func(tx *ent.Tx) error {
+		_, err := tx.Email.Delete().Where(email.AddressEQ(address), email.VerifiedEQ(false)).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_user, err = tx.User.Create().SetEmail(address).Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Email.Create().
+			SetUser(_user).
+			SetAddress(address).
+			SetVerified(true).
+			SetVerifiedAt(time.Now()).
+			SetVerifiedAddress(address).
+			SetPrimary(true).
+			Save(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return _user.Unwrap(), nil
+}
+
+// addEmail adds the unverified address to the user.
+// An address can't be added if it's verified by another user, other users may have added it unverified too.
+func addEmail(userID int, address string) (*ent.Email, error) {
+	taken, err := client.User.Query().
+		Where(user.IDNEQ(userID)).
+		Where(user.Or(
+			user.EmailEQ(address),
+			user.HasEmailsWith(email.AddressEQ(address), email.VerifiedEQ(true)),
+		)).
+		Exist(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, errEmailInUse
+	}
+
+	_email, err := client.Email.Query().
+		Where(email.AddressEQ(address)).
+		Where(email.HasUserWith(user.IDEQ(userID))).
+		Only(ctx)
+	if err == nil {
+		return _email, nil
+	}
+	if !ent.IsNotFound(err) {
+		return nil, err
+	}
+
+	_email, err = client.Email.Create().SetUserID(userID).SetAddress(address).Save(ctx)
+	// The user has added the address at the same time
+	if ent.IsConstraintError(err) {
+		return client.Email.Query().
+			Where(email.AddressEQ(address)).
+			Where(email.HasUserWith(user.IDEQ(userID))).
+			Only(ctx)
+	}
+	return _email, err
+}
+
+// verifyEmail marks the address of the user verified, the unverified records of the address added by other users are deleted.
+// errEmailInUse is returned if another user has verified the address, the verified address is unique in the database.
+func verifyEmail(userID int, _email *ent.Email) error {
+	err := WithTx(ctx, client, func(tx *ent.Tx) error {
+		taken, err := tx.User.Query().
+			Where(user.IDNEQ(userID)).
+			Where(user.EmailEQ(_email.Address)).
+			Exist(ctx)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return errEmailInUse
+		}
+
+		err = tx.Email.UpdateOneID(_email.ID).
+			SetVerified(true).
+			SetVerifiedAt(time.Now()).
+			SetVerifiedAddress(_email.Address).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Email.Delete().
+			Where(email.AddressEQ(_email.Address), email.VerifiedEQ(false)).
+			Where(email.Not(email.HasUserWith(user.IDEQ(userID)))).
+			Exec(ctx)
+		return err
+	})
+	if ent.IsConstraintError(errors.Cause(err)) {
+		return errEmailInUse
+	}
+	return err
+}
+
+// makePrimaryEmail makes the verified address the primary email of the user
+func makePrimaryEmail(userID int, _email *ent.Email) error {
+	return WithTx(ctx, client, func(tx *ent.Tx) error {
+		_, err := tx.Email.Update().
+			Where(email.HasUserWith(user.IDEQ(userID))).
+			Where(email.IDNEQ(_email.ID)).
+			SetPrimary(false).
+			Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Email.UpdateOne(_email).SetPrimary(true).Exec(ctx); err != nil {
+			return err
+		}
+
+		return tx.User.UpdateOneID(userID).SetEmail(_email.Address).Exec(ctx)
+	})
+}
+
+// userEmailOf returns the email record of the id param of the user of the request.
+// Otherwise the error response is written, and the record is nil.
+func userEmailOf(c *Context) (*ent.User, *ent.Email, error) {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return nil, nil, c.Unauthorized(err.Error())
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, nil, c.BadRequest("Invalid email id")
+	}
+
+	_email, err := client.Email.Query().
+		Where(email.IDEQ(id)).
+		Where(email.HasUserWith(user.IDEQ(_user.ID))).
+		Only(ctx)
+	if err != nil {
+		return nil, nil, c.NotFound("Email not found")
+	}
+
+	return _user, _email, nil
+}
+
+// GetAccountEmails lists the email addresses of the user, the primary one first
+func GetAccountEmails(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	emails, err := client.Email.Query().
+		Where(email.HasUserWith(user.IDEQ(_user.ID))).
+		Order(ent.Desc(email.FieldPrimary), ent.Asc(email.FieldCreatedAt)).
+		All(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(emails)
+}
+
+// PostAccountEmail adds an email address to the user, and sends the verification code to it
+func PostAccountEmail(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	var form struct {
+		Email string `json:"email" binding:"required"`
+	}
+	err = c.ShouldBindJSON(&form)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	if !VerifyEmailFormat(form.Email) {
+		return c.BadRequest("Email is invalid")
+	}
+
+	if !allowRequest(c, "code", form.Email) {
+		return c.TooManyRequests("Too many verification codes requested, please try again later")
+	}
+
+	_email, err := addEmail(_user.ID, form.Email)
+	if err == errEmailInUse {
+		return c.Conflict(err.Error())
+	}
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+	if _email.Verified {
+		return c.Conflict("The email has been added")
+	}
+
+	code := NewVerificationCode()
+	body, err := renderTemplate(c.Locale(), tlpMailEmail, struct {
+		Code string
+	}{code})
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	// The code is stored before it's sent, so that it can be verified as soon as it's received
+	key := "email:" + strconv.Itoa(_email.ID)
+	err = userVerificaBox.SetVal(key, emailVerification{Code: code, UserID: _user.ID})
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+	userVerificaBox.DelString("attempts:" + key)
+
+	err = EnqueueMail(_email.Address, c.T("Verify your email address for WHOAM"), body)
+	if err != nil {
+		userVerificaBox.DelString(key)
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(_email)
+}
+
+// PostAccountEmailVerify verifies the added email address with the code sent to it
+func PostAccountEmailVerify(c *Context) error {
+	var form struct {
+		Code string `json:"code" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	_user, _email, err := userEmailOf(c)
+	if _email == nil {
+		return err
+	}
+
+	if _email.Verified {
+		return c.NoContent()
+	}
+
+	key := "email:" + strconv.Itoa(_email.ID)
+	var src emailVerification
+	if err = userVerificaBox.Val(key, &src); err != nil || src.UserID != _user.ID {
+		return c.Unauthorized("Verification failed: token is invalid or code is expired")
+	}
+
+	if !equalString(src.Code, strings.ToTitle(form.Code)) {
+		failVerification(key)
+		return c.Unauthorized("Verification failed: code is invalid")
+	}
+
+	// The code is single-use, only one of the concurrent requests takes it
+	if _, err = userVerificaBox.Take(key); err != nil {
+		return c.Unauthorized("Verification failed: token is invalid or code is expired")
+	}
+	userVerificaBox.DelString("attempts:" + key)
+
+	err = verifyEmail(_user.ID, _email)
+	if err == errEmailInUse {
+		return c.Conflict(err.Error())
+	}
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// PostAccountEmailPrimary makes the verified email address primary,
+// the primary email is the email of the user shown to the services.
+func PostAccountEmailPrimary(c *Context) error {
+	_user, _email, err := userEmailOf(c)
+	if _email == nil {
+		return err
+	}
+
+	if !_email.Verified {
+		return c.PreconditionFailed("Only a verified email can be primary")
+	}
+
+	if err = makePrimaryEmail(_user.ID, _email); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// DeleteAccountEmail removes the email address of the user, except the primary one
+func DeleteAccountEmail(c *Context) error {
+	_, _email, err := userEmailOf(c)
+	if _email == nil {
+		return err
+	}
+
+	if _email.Primary {
+		return c.BadRequest("The primary email can't be removed")
+	}
+
+	if err = client.Email.DeleteOne(_email).Exec(ctx); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	userVerificaBox.DelString("email:" + strconv.Itoa(_email.ID))
+	return c.NoContent()
+}
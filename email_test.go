@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent/email"
+	"whoam.xyz/ent/user"
+)
+
+func TestAccountEmails(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := createUser("emails@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := _user.QueryEmails().Only(ctx)
+	if err != nil || !primary.Verified || !primary.Primary || "emails@example.com" != primary.Address {
+		t.Fatal("the email of the created user should be its verified primary email", primary, err)
+	}
+
+	other, err := createUser("emails.other@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = addEmail(other.ID, "emails@example.com"); err != errEmailInUse {
+		t.Error("the verified email of another user can't be added", err)
+	}
+
+	// An unverified email can be added by anyone, the others are deleted when one of them verifies it
+	pending, err := addEmail(other.ID, "secondary@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := addEmail(_user.ID, "secondary@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := addEmail(_user.ID, "secondary@example.com"); err != nil || again.ID != secondary.ID {
+		t.Error("the email added again should be the same record", again, err)
+	}
+	if n, _ := client.Email.Query().Where(email.AddressEQ("secondary@example.com")).Count(ctx); 2 != n {
+		t.Error("the unverified email of another user should be kept", n)
+	}
+	if _, err = userOfEmail("secondary@example.com"); err == nil {
+		t.Error("the user can't log in with an unverified email")
+	}
+
+	key := "email:" + strconv.Itoa(secondary.ID)
+	if err = userVerificaBox.SetVal(key, emailVerification{Code: "CODE", UserID: _user.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := newSessionContext("POST")
+	_session, err := newSession(c, _user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// emailRequest is the request of the user to the email handler
+	emailRequest := func(handler func(*Context) error, body string) int {
+		c, w := newSessionContext("POST", cookie)
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.Header.Set(csrfHeader, _session.CsrfToken)
+		c.Request.AddCookie(cookie)
+		c.Params = gin.Params{{Key: "id", Value: strconv.Itoa(secondary.ID)}}
+		handler(c)
+		return w.Code
+	}
+
+	if code := emailRequest(PostAccountEmailPrimary, ""); http.StatusPreconditionFailed != code {
+		t.Error("the unverified email can't be primary", code)
+	}
+	if code := emailRequest(PostAccountEmailVerify, `{"code":"wrong"}`); http.StatusUnauthorized != code {
+		t.Error("the email shouldn't be verified with a wrong code", code)
+	}
+	if code := emailRequest(PostAccountEmailVerify, `{"code":"code"}`); http.StatusNoContent != code {
+		t.Error("the email should be verified with the code", code)
+	}
+	if exist, _ := client.Email.Query().Where(email.IDEQ(pending.ID)).Exist(ctx); exist {
+		t.Error("the unverified email of another user should be deleted once it's verified")
+	}
+	if code := emailRequest(PostAccountEmailPrimary, ""); http.StatusNoContent != code {
+		t.Error("the verified email should be made primary", code)
+	}
+
+	logged, err := userOfEmail("secondary@example.com")
+	if err != nil || logged.ID != _user.ID {
+		t.Error("the user should log in with the verified secondary email", logged, err)
+	}
+
+	if _, err = addEmail(other.ID, "secondary@example.com"); err != errEmailInUse {
+		t.Error("the verified secondary email of another user can't be added", err)
+	}
+	if _, err = client.Email.Create().SetUserID(other.ID).SetAddress("secondary@example.com").SetVerifiedAddress("secondary@example.com").Save(ctx); err == nil {
+		t.Error("the verified address should be unique")
+	}
+
+	primaryCount, _ := client.Email.Query().
+		Where(email.HasUserWith(user.IDEQ(_user.ID))).
+		Where(email.PrimaryEQ(true)).
+		Count(ctx)
+	_user, _ = client.User.Get(ctx, _user.ID)
+	if 1 != primaryCount || "secondary@example.com" != _user.Email {
+		t.Error("the user should have one primary email, which is its email", primaryCount, _user.Email)
+	}
+
+	primary, _ = client.Email.Get(ctx, primary.ID)
+	if primary.Primary {
+		t.Error("the previous primary email shouldn't be primary", primary)
+	}
+	if code := emailRequest(DeleteAccountEmail, ""); http.StatusBadRequest != code {
+		t.Error("the primary email can't be removed", code)
+	}
+}
+
+func TestProfileClaims(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().
+		SetEmail("profile@example.com").
+		SetName("Profile").
+		SetAvatarURL("https://example.com/avatar.png").
+		SetLocale("zh-CN").
+		SetTimezone("Asia/Shanghai").
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims := profileClaimsOf(_user, "openid"); (ProfileClaims{}) != claims {
+		t.Error("no claims should be granted without the email or profile scope", claims)
+	}
+
+	claims := profileClaimsOf(_user, "openid email")
+	if "profile@example.com" != claims.Email || !claims.EmailVerified || "" != claims.Name {
+		t.Error("only the email should be granted by the email scope", claims)
+	}
+
+	claims = profileClaimsOf(_user, "profile")
+	if "" != claims.Email || "Profile" != claims.Name || "https://example.com/avatar.png" != claims.Picture ||
+		"zh-CN" != claims.Locale || "Asia/Shanghai" != claims.Zoneinfo || 0 == claims.UpdatedAt {
+		t.Error("only the profile should be granted by the profile scope", claims)
+	}
+}
@@ -0,0 +1,45 @@
+package schema
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/edge"
+	"github.com/facebook/ent/schema/field"
+	"github.com/facebook/ent/schema/index"
+)
+
+// Email holds the schema definition for the Email entity,
+// an email address of the user, the primary one is also the email of the user.
+// Users may add the same address before it's verified, a verified address belongs to one user.
+type Email struct {
+	ent.Schema
+}
+
+// Fields of the Email.
+func (Email) Fields() []ent.Field {
+	return []ent.Field{
+		field.Time("created_at").Default(time.Now).Immutable(),
+		field.String("address").Match(regexp.MustCompile(`\w+([-+.]\w+)*@\w+([-.]\w+)*\.\w+([-.]\w+)*`)).Immutable(),
+		field.Bool("verified").Default(false), // Whether the user has proved control of the address with a code
+		field.Time("verified_at").Optional().Nillable(),
+		field.String("verified_address").Optional().Nillable().StructTag(`json:"-"`), // The address once it's verified, unique among the verified addresses
+		field.Bool("primary").Default(false),                                         // Only a verified address can be primary, the user has one primary address
+	}
+}
+
+// Indexes of the Email.
+func (Email) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("address").Edges("user").Unique(),
+		index.Fields("verified_address").Unique(),
+	}
+}
+
+// Edges of the Email.
+func (Email) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).Ref("emails").Required().Unique(),
+	}
+}
@@ -0,0 +1,40 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/edge"
+	"github.com/facebook/ent/schema/field"
+	"github.com/facebook/ent/schema/index"
+)
+
+// Grant holds the schema definition for the Grant entity,
+// it records the scopes the user has consented to the service.
+type Grant struct {
+	ent.Schema
+}
+
+// Fields of the Grant.
+func (Grant) Fields() []ent.Field {
+	return []ent.Field{
+		field.Time("created_at").Default(time.Now).Immutable(),
+		field.Time("updated_at").Default(time.Now).UpdateDefault(time.Now),
+		field.Strings("scopes"),
+	}
+}
+
+// Edges of the Grant.
+func (Grant) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).Ref("grants").Required().Unique(),
+		edge.To("service", Service.Type).Required().Unique(),
+	}
+}
+
+// Indexes of the Grant.
+func (Grant) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Edges("user", "service").Unique(),
+	}
+}
@@ -0,0 +1,37 @@
+package schema
+
+import (
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/field"
+	"github.com/facebook/ent/schema/index"
+)
+
+// KeyValue holds the schema definition for the KeyValue entity,
+// the expiring entries of the database KVStore.
+type KeyValue struct {
+	ent.Schema
+}
+
+// Fields of the KeyValue.
+func (KeyValue) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("id").
+			NotEmpty().
+			Unique().
+			Immutable(),
+		field.Bytes("value"),
+		field.Time("expired_at").Optional().Nillable(), // never expires if nil
+	}
+}
+
+// Edges of the KeyValue.
+func (KeyValue) Edges() []ent.Edge {
+	return nil
+}
+
+// Indexes of the KeyValue.
+func (KeyValue) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("expired_at"),
+	}
+}
@@ -0,0 +1,42 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/field"
+	"github.com/facebook/ent/schema/index"
+)
+
+// Mail holds the schema definition for the Mail entity,
+// it's an email of the outbox, sent by the background workers.
+type Mail struct {
+	ent.Schema
+}
+
+// Fields of the Mail.
+func (Mail) Fields() []ent.Field {
+	return []ent.Field{
+		field.Time("created_at").Default(time.Now).Immutable(),
+		field.String("to").Immutable().NotEmpty(),
+		field.String("subject").Immutable(),
+		field.Text("body").Immutable(),
+		field.Enum("status").Values("pending", "sending", "sent", "dead").Default("pending"),
+		field.Int("attempts").Default(0),
+		field.Time("next_attempt_at").Default(time.Now), // When a pending mail is due, or the lease of a sending mail expires
+		field.String("last_error").Optional(),
+		field.Time("sent_at").Optional().Nillable(),
+	}
+}
+
+// Edges of the Mail.
+func (Mail) Edges() []ent.Edge {
+	return nil
+}
+
+// Indexes of the Mail.
+func (Mail) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("status", "next_attempt_at"),
+	}
+}
@@ -19,6 +19,10 @@ func (Oauth) Fields() []ent.Field {
 		field.Time("created_at").Default(time.Now).Immutable(),
 		field.Time("expired_at"),
 		field.String("main_token").Immutable().Unique().NotEmpty(),
+		field.String("scope").Immutable().Default(""),
+		field.String("family").Immutable().Optional(),      // All refresh tokens rotated from the same authorization
+		field.Time("authorized_at").Immutable().Optional(), // The time when the family was authorized
+		field.Time("rotated_at").Optional().Nillable(),     // The time when the refresh token was rotated
 	}
 }
 
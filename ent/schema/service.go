@@ -4,6 +4,7 @@ import (
 	"regexp"
 
 	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/edge"
 	"github.com/facebook/ent/schema/field"
 )
 
@@ -24,5 +25,25 @@ func (Service) Fields() []ent.Field {
 		field.String("domain").Match(
 			regexp.MustCompile(`https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()@:%_\+.~#?&//=]*)`)),
 		field.String("clone_uri").Match(regexp.MustCompile(`((git|ssh|http(s)?)|(git@[\w\.]+))(:(//)?)([\w\.@\:/\-~]+)(\.git)(/)?`)),
+		field.Strings("redirect_uris").Optional(),
+		field.Bool("require_pkce").Default(false),
+		field.Strings("scopes").Optional(),
+		field.Int("max_session_lifetime").Default(0).NonNegative(), // Seconds, the absolute lifetime of refresh token families, 0 is unlimited
+		field.String("secret_hash").Optional().Sensitive(),
+		field.String("previous_secret_hash").Optional().Sensitive(),
+		field.Time("previous_secret_expired_at").Optional().Nillable(),
+		field.Enum("status").Values("unverified", "verified").Default("unverified"), // Whether the service has proved control of its domain
+		field.String("verification_token").Optional().Sensitive(),                   // The challenge served by the domain to prove control
+		field.Time("verified_at").Optional().Nillable(),
+		field.Time("checked_at").Optional().Nillable(),                     // The time when the verified domain was checked again
+		field.Int("check_failures").Default(0).NonNegative(),               // Consecutive failed checks of the verified domain
+		field.Enum("subject_type").Values("public", "pairwise").Optional(), // The subject identifier type of the users, config.SubjectType if empty
+	}
+}
+
+// Edges of the Service.
+func (Service) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).Ref("services").Unique(), // The user who registered the service, none for the main service
 	}
 }
@@ -0,0 +1,35 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/edge"
+	"github.com/facebook/ent/schema/field"
+)
+
+// Session holds the schema definition for the Session entity,
+// it's the browser session of the whoam web UI, the session token is kept in an HttpOnly cookie.
+type Session struct {
+	ent.Schema
+}
+
+// Fields of the Session.
+func (Session) Fields() []ent.Field {
+	return []ent.Field{
+		field.Time("created_at").Default(time.Now).Immutable(),      // The time when the user logged in
+		field.Time("last_used_at").Default(time.Now),                // The session is ended after the idle timeout since it was last used
+		field.Time("expired_at").Immutable(),                        // The session is ended at it, however active it is
+		field.String("token_hash").Unique().Immutable().Sensitive(), // SHA-256 of the session token of the cookie
+		field.String("csrf_token").Immutable().Sensitive(),
+		field.String("user_agent").Immutable().Default(""),
+		field.String("ip").Immutable().Default(""),
+	}
+}
+
+// Edges of the Session.
+func (Session) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("user", User.Type).Ref("sessions").Required().Unique(),
+	}
+}
@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/facebook/ent"
+	"github.com/facebook/ent/schema/field"
+)
+
+// SigningKey holds the schema definition for the SigningKey entity.
+type SigningKey struct {
+	ent.Schema
+}
+
+// Fields of the SigningKey.
+func (SigningKey) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("id").
+			NotEmpty().
+			Unique().
+			Immutable(),
+		field.Enum("algorithm").Values("RS256", "ES256", "EdDSA").Immutable(),
+		field.String("private_key").Immutable().Sensitive().NotEmpty(),
+		field.Time("created_at").Default(time.Now).Immutable(),
+		field.Time("retired_at").Optional().Nillable(),
+	}
+}
+
+// Edges of the SigningKey.
+func (SigningKey) Edges() []ent.Edge {
+	return nil
+}
@@ -20,6 +20,10 @@ func (User) Fields() []ent.Field {
 		field.Time("created_at").Default(time.Now).Immutable(),
 		field.Time("updated_at").Default(time.Now).UpdateDefault(time.Now),
 		field.String("email").Match(regexp.MustCompile(`\w+([-+.]\w+)*@\w+([-.]\w+)*\.\w+([-.]\w+)*`)).Unique(),
+		field.String("name").Optional().MaxLen(64),        // The display name
+		field.String("avatar_url").Optional().MaxLen(512), // URL of the avatar picture
+		field.String("locale").Optional(),                 // BCP 47 language tag, such as en or zh-CN
+		field.String("timezone").Optional(),               // IANA time zone, such as Asia/Shanghai
 	}
 }
 
@@ -27,5 +31,9 @@ func (User) Fields() []ent.Field {
 func (User) Edges() []ent.Edge {
 	return []ent.Edge{
 		edge.To("oauths", Oauth.Type),
+		edge.To("grants", Grant.Type),
+		edge.To("services", Service.Type),
+		edge.To("sessions", Session.Type),
+		edge.To("emails", Email.Type),
 	}
 }
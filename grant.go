@@ -0,0 +1,134 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/grant"
+	"whoam.xyz/ent/service"
+	"whoam.xyz/ent/user"
+)
+
+// standardScopes the scopes supported by whoam, and their descriptions shown on the consent page,
+// the descriptions are translated by the message catalogs.
+// A service can define its own scopes in addition to these.
+var standardScopes = map[string]string{
+	"openid":  "Sign in with your whoam account",
+	"email":   "View your email address",
+	"profile": "View your basic profile",
+}
+
+// scopeInfo is a scope shown on the consent page
+type scopeInfo struct {
+	Name        string
+	Description string
+}
+
+// parseScope returns the scopes of the space-delimited scope, sorted and without duplicates
+func parseScope(scope string) []string {
+	set := make(map[string]bool)
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !set[s] {
+			set[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// scopeToken see RFC 6749 §3.3
+var scopeToken = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]+$`)
+
+// validScope reports whether the s can be defined as a custom scope of a service
+func validScope(s string) bool {
+	_, standard := standardScopes[s]
+	return !standard && scopeToken.MatchString(s)
+}
+
+// checkScope validates the requested scope of the service, and returns the normalized scopes,
+// see RFC 6749 §3.3
+func checkScope(_service *ent.Service, scope string) ([]string, *oauthError) {
+	scopes := parseScope(scope)
+
+	for _, s := range scopes {
+		if _, ok := standardScopes[s]; ok {
+			continue
+		}
+		if !containsString(_service.Scopes, s) {
+			return nil, invalidScope("Unknown scope: " + s)
+		}
+	}
+
+	return scopes, nil
+}
+
+// scopeInfos returns the descriptions of the scopes
+func scopeInfos(scopes []string) []scopeInfo {
+	infos := make([]scopeInfo, len(scopes))
+	for i, s := range scopes {
+		desc, ok := standardScopes[s]
+		if !ok {
+			desc = s
+		}
+		infos[i] = scopeInfo{s, desc}
+	}
+	return infos
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// queryGrant returns the grant of the user to the service
+func queryGrant(userID int, serviceID string) (*ent.Grant, error) {
+	return client.Grant.Query().
+		Where(grant.HasUserWith(user.IDEQ(userID))).
+		Where(grant.HasServiceWith(service.IDEQ(serviceID))).
+		Only(ctx)
+}
+
+// isGranted reports whether the user has consented all the scopes to the service
+func isGranted(userID int, serviceID string, scopes []string) bool {
+	_grant, err := queryGrant(userID, serviceID)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range scopes {
+		if !containsString(_grant.Scopes, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveGrant records that the user has consented the scopes to the service,
+// the scopes are added to the previously granted scopes.
+func saveGrant(userID int, serviceID string, scopes []string) error {
+	_grant, err := queryGrant(userID, serviceID)
+	if ent.IsNotFound(err) {
+		_, err = client.Grant.Create().
+			SetUserID(userID).
+			SetServiceID(serviceID).
+			SetScopes(scopes).
+			Save(ctx)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	granted := parseScope(strings.Join(append(_grant.Scopes, scopes...), " "))
+	_, err = _grant.Update().SetScopes(granted).Save(ctx)
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobuffalo/packr/v2"
+)
+
+// catalogs are the translated messages of every locale, the message ID is the English message.
+// A message without translation is shown as its ID.
+var catalogs map[string]map[string]string
+
+// templates are the HTML page and email templates of every locale,
+// `{{ T "message" args... }}` translates the message into the locale, and `{{ locale }}` is the locale.
+var templates map[string]*template.Template
+
+// InitI18n loads the message catalogs, and parses the templates for every locale.
+// The templates of config.TemplateDir override the built-in templates of the same name.
+func InitI18n() {
+	var err error
+	catalogs, err = loadCatalogs(packr.NewBox("./locales"))
+	if err != nil {
+		panic("failed to load message catalogs: " + err.Error())
+	}
+
+	templates, err = loadTemplates(packr.NewBox("./html"), config.TemplateDir)
+	if err != nil {
+		panic("failed to parse templates: " + err.Error())
+	}
+}
+
+// loadCatalogs loads the <locale>.json catalogs of the box
+func loadCatalogs(box *packr.Box) (map[string]map[string]string, error) {
+	catalogs := make(map[string]map[string]string)
+	for _, name := range box.List() {
+		if ".json" != filepath.Ext(name) {
+			continue
+		}
+
+		data, err := box.Find(name)
+		if err != nil {
+			return nil, err
+		}
+
+		catalog := make(map[string]string)
+		if err = json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		catalogs[strings.TrimSuffix(name, ".json")] = catalog
+	}
+	return catalogs, nil
+}
+
+// loadTemplates parses the templates of the box for every locale,
+// the files of the dir override the templates of the same name, if the dir isn't empty.
+func loadTemplates(box *packr.Box, dir string) (map[string]*template.Template, error) {
+	sources := make(map[string]string)
+	for _, name := range box.List() {
+		data, err := box.FindString(name)
+		if err != nil {
+			return nil, err
+		}
+		sources[filepath.ToSlash(name)] = data
+	}
+
+	if "" != dir {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sources[filepath.ToSlash(name)] = string(data)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make(map[string]*template.Template)
+	for locale := range catalogs {
+		locale := locale
+		tmpl := template.New("whoam").Funcs(template.FuncMap{
+			"T": func(id string, args ...interface{}) string {
+				return translate(locale, id, args...)
+			},
+			"locale": func() string {
+				return locale
+			},
+		})
+
+		for _, name := range names {
+			if _, err := tmpl.New(name).Parse(sources[name]); err != nil {
+				return nil, err
+			}
+		}
+		templates[locale] = tmpl
+	}
+	return templates, nil
+}
+
+// translate returns the message of the id in the locale, formatted with the args
+func translate(locale string, id string, args ...interface{}) string {
+	message, ok := catalogs[locale][id]
+	if !ok || "" == message {
+		message = id
+	}
+
+	if 0 == len(args) {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// renderTemplate executes the template of the name in the locale
+func renderTemplate(locale string, name string, data interface{}) (string, error) {
+	tmpl, ok := templates[locale]
+	if !ok {
+		tmpl = templates[config.Locale]
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// negotiateLocale returns the supported locale of the highest preference,
+// the ui_locales (OIDC Core §3.1.2.1) takes precedence over the Accept-Language header (RFC 7231 §5.3.5).
+// If none is supported, config.Locale is returned.
+func negotiateLocale(uiLocales string, acceptLanguage string) string {
+	for _, tag := range strings.Fields(uiLocales) {
+		if locale, ok := matchLocale(tag); ok {
+			return locale
+		}
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.TrimSpace(params[0])
+		if "" == tag || "*" == tag {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if 0 < q {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if locale, ok := matchLocale(t.tag); ok {
+			return locale
+		}
+	}
+
+	return config.Locale
+}
+
+// matchLocale returns the supported locale of the language tag,
+// such as zh-CN for zh-CN, zh-cn or zh, and en for en-US.
+func matchLocale(tag string) (string, bool) {
+	tag = strings.Replace(tag, "_", "-", -1)
+	language := strings.ToLower(strings.Split(tag, "-")[0])
+
+	var candidate string
+	for locale := range catalogs {
+		if strings.EqualFold(locale, tag) {
+			return locale, true
+		}
+		if language == strings.ToLower(strings.Split(locale, "-")[0]) && ("" == candidate || locale < candidate) {
+			candidate = locale
+		}
+	}
+	return candidate, "" != candidate
+}
+
+// Localize middleware negotiates the locale of the request
+func Localize(c *gin.Context) {
+	uiLocales := c.Query("ui_locales")
+	if "" == uiLocales {
+		uiLocales = c.PostForm("ui_locales")
+	}
+
+	locale := negotiateLocale(uiLocales, c.GetHeader("Accept-Language"))
+	c.Set("locale", locale)
+	c.Header("Content-Language", locale)
+	c.Writer.Header().Add("Vary", "Accept-Language")
+
+	c.Next()
+}
+
+// Locale returns the negotiated locale of the request
+func (p *Context) Locale() string {
+	if locale, ok := p.Get("locale"); ok {
+		return locale.(string)
+	}
+	return config.Locale
+}
+
+// T translates the message of the id into the locale of the request
+func (p *Context) T(id string, args ...interface{}) string {
+	return translate(p.Locale(), id, args...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobuffalo/packr/v2"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	InitI18n()
+
+	tests := []struct {
+		uiLocales      string
+		acceptLanguage string
+		locale         string
+	}{
+		{"", "", config.Locale},
+		{"", "zh-CN,zh;q=0.9,en;q=0.8", "zh-CN"},
+		{"", "en-US,en;q=0.9,zh-CN;q=0.8", "en"},
+		{"", "fr-FR, zh;q=0.5, en;q=0.7", "en"},
+		{"", "zh-TW", "zh-CN"},
+		{"", "zh_cn", "zh-CN"},
+		{"", "en;q=0, zh", "zh-CN"},
+		{"", "fr, *;q=0.1", config.Locale},
+		{"zh-CN", "en", "zh-CN"},
+		{"fr en", "zh-CN", "en"},
+		{"fr", "zh-CN", "zh-CN"},
+	}
+
+	for _, tt := range tests {
+		if locale := negotiateLocale(tt.uiLocales, tt.acceptLanguage); locale != tt.locale {
+			t.Errorf("negotiateLocale(%q, %q) = %v, want %v", tt.uiLocales, tt.acceptLanguage, locale, tt.locale)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	InitI18n()
+
+	if s := translate("zh-CN", "Email is invalid"); "邮箱地址无效" != s {
+		t.Error("message should be translated", s)
+	}
+	if s := translate("zh-CN", "Unregistered redirect_uri: %v", "https://a.com"); "未注册的 redirect_uri：https://a.com" != s {
+		t.Error("message should be translated with the args", s)
+	}
+	if s := translate("zh-CN", "Untranslated message"); "Untranslated message" != s {
+		t.Error("untranslated message should be its id", s)
+	}
+
+	// Every message of the catalogs should be translated in all locales
+	for id := range catalogs["zh-CN"] {
+		for locale, catalog := range catalogs {
+			if _, ok := catalog[id]; !ok {
+				t.Errorf("message %q isn't in the %v catalog", id, locale)
+			}
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	InitI18n()
+
+	data := struct{ Code, Link string }{"AB12", "https://whoam.xyz/user/approve?token=xyz"}
+	body, err := renderTemplate("zh-CN", tlpMailVerification, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "AB12") || !strings.Contains(body, "验证码") || !strings.Contains(body, data.Link) {
+		t.Error("the verification email should be translated", body)
+	}
+
+	body, err = renderTemplate("en", tlpMailVerification, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "AB12") || !strings.Contains(body, "Verification code:") {
+		t.Error("the verification email should be in English", body)
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	InitI18n()
+
+	dir, err := ioutil.TempDir("", "whoam-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "mail"), 0700)
+	override := `<p>{{ T "Verification code:" }} <code>{{ .Code }}</code></p>`
+	if err = ioutil.WriteFile(filepath.Join(dir, "mail", "verification.html"), []byte(override), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err = loadTemplates(packr.NewBox("./html"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer InitI18n()
+
+	body, err := renderTemplate("zh-CN", tlpMailVerification, struct{ Code string }{"AB12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "<p>验证码： <code>AB12</code></p>" != body {
+		t.Error("the template should be overridden", body)
+	}
+
+	page, err := renderTemplate("zh-CN", tlpUserLogin, nil)
+	if err != nil || !strings.Contains(page, "OAuth授权-WHOAM") {
+		t.Error("the built-in templates should be still available", err)
+	}
+}
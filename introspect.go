@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+
+	"whoam.xyz/ent/oauth"
+)
+
+// introspectionResponse is the introspection response of RFC 7662 §2.2
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ID        string `json:"jti,omitempty"`
+}
+
+// PostOAuthIntrospect is the token introspection endpoint of RFC 7662,
+// only confidential services can introspect the tokens issued to themselves.
+// Revoked, expired or other service's tokens are inactive.
+func PostOAuthIntrospect(c *Context) error {
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	if !isConfidential(_service) {
+		return c.OAuthError(unauthorizedClient("Only confidential clients can introspect tokens"))
+	}
+
+	token, err := c.GetFormString("token")
+	if err != nil {
+		return c.OAuthError(invalidRequest(err.Error()))
+	}
+
+	c.Header("Cache-Control", "no-store")
+
+	inactive := &introspectionResponse{Active: false}
+
+	// Access tokens are JWT and refresh tokens are opaque, so the token_type_hint isn't needed
+	if claims, err := FilterJWTToken(token, jwtKeys); err == nil {
+		if claims.Audience != _service.ID {
+			return c.Ok(inactive)
+		}
+
+		return c.Ok(&introspectionResponse{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientID:  claims.Audience,
+			TokenType: "Bearer",
+			ExpiresAt: claims.ExpiresAt,
+			IssuedAt:  claims.IssuedAt,
+			Subject:   claims.Subject,
+			Audience:  claims.Audience,
+			Issuer:    claims.Issuer,
+			ID:        claims.Id,
+		})
+	}
+
+	auth, err := client.Oauth.Query().
+		Where(oauth.MainTokenEQ(token)).
+		Where(oauth.ExpiredAtGT(time.Now())).
+		Where(oauth.RotatedAtIsNil()).
+		WithUser().
+		WithService().
+		Only(ctx)
+	if err != nil || auth.Edges.Service.ID != _service.ID {
+		return c.Ok(inactive)
+	}
+
+	return c.Ok(&introspectionResponse{
+		Active:    true,
+		Scope:     auth.Scope,
+		ClientID:  auth.Edges.Service.ID,
+		TokenType: "refresh_token",
+		ExpiresAt: auth.ExpiredAt.Unix(),
+		IssuedAt:  auth.CreatedAt.Unix(),
+		Subject:   subjectOf(auth.Edges.User.ID, auth.Edges.Service),
+		Audience:  auth.Edges.Service.ID,
+		Issuer:    issuer(),
+	})
+}
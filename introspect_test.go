@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent"
+)
+
+// createConfidentialService creates a service with a client secret, and returns the secret
+func createConfidentialService(t *testing.T, id string) (*ent.Service, string) {
+	secret, hash := newClientSecret()
+	_service, err := createSubjectService(t, id, "").Update().SetSecretHash(hash).Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return _service, secret
+}
+
+// introspect requests the introspection endpoint as the client, and returns the status code and the JSON response,
+// the token parameter is missing if the token is empty
+func introspect(clientID string, secret string, token string) (int, map[string]interface{}) {
+	form := url.Values{}
+	if "" != token {
+		form.Set("token", token)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/oauth/introspect", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.Request.SetBasicAuth(clientID, secret)
+	PostOAuthIntrospect(&Context{c})
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestPostOAuthIntrospect(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("introspect@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_service, secret := createConfidentialService(t, "introspect.example.com")
+	other, otherSecret := createConfidentialService(t, "other.introspect.example.com")
+
+	accessToken, auth, err := newOAuthToken(_user.ID, _service.ID, "openid email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := introspect(_service.ID, secret, accessToken)
+	if http.StatusOK != status || true != response["active"] {
+		t.Fatal("the access token should be active", status, response)
+	}
+	if "openid email" != response["scope"] || _service.ID != response["client_id"] || "Bearer" != response["token_type"] ||
+		subjectOf(_user.ID, _service) != response["sub"] || "" == response["jti"] {
+		t.Error("the response should have the claims of the access token", response)
+	}
+
+	status, response = introspect(_service.ID, secret, auth.MainToken)
+	if true != response["active"] || "refresh_token" != response["token_type"] || "openid email" != response["scope"] {
+		t.Error("the refresh token should be active", status, response)
+	}
+
+	// The tokens of another audience are inactive, no claims are disclosed
+	for _, token := range []string{accessToken, auth.MainToken} {
+		if status, response = introspect(other.ID, otherSecret, token); http.StatusOK != status || false != response["active"] || 1 != len(response) {
+			t.Error("the token of another audience should be inactive", status, response)
+		}
+	}
+
+	for name, token := range map[string]string{"an unknown token": "unknown", "a malformed token": "not.a.token"} {
+		if status, response = introspect(_service.ID, secret, token); http.StatusOK != status || false != response["active"] {
+			t.Error(name+" should be inactive", status, response)
+		}
+	}
+
+	expired, err := NewJWTToken(_user.ID, _service, "", "openid", -time.Minute, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, response = introspect(_service.ID, secret, expired); false != response["active"] {
+		t.Error("the expired access token should be inactive", response)
+	}
+
+	// The revoked tokens are inactive
+	if err = revokeOAuths(auth); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{accessToken, auth.MainToken} {
+		if _, response = introspect(_service.ID, secret, token); false != response["active"] {
+			t.Error("the revoked token should be inactive", response)
+		}
+	}
+}
+
+func TestPostOAuthIntrospectClient(t *testing.T) {
+	setupOAuth(t)
+
+	_service, secret := createConfidentialService(t, "client.introspect.example.com")
+	public := createSubjectService(t, "public.introspect.example.com", "")
+
+	if status, response := introspect(_service.ID, "wrong", "token"); http.StatusUnauthorized != status || "invalid_client" != response["error"] {
+		t.Error("the client with a wrong secret should be unauthorized", status, response)
+	}
+
+	if status, response := introspect(public.ID, "", "token"); "unauthorized_client" != response["error"] {
+		t.Error("the public client can't introspect tokens", status, response)
+	}
+
+	if status, response := introspect(_service.ID, secret, ""); "invalid_request" != response["error"] {
+		t.Error("the token is required", status, response)
+	}
+}
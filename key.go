@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/signingkey"
+)
+
+const timeoutRetiredKey = 24 * time.Hour   // retired signing key is kept for verification: 1day
+const timeoutKeyPublish = time.Hour        // new signing key is published before signing tokens, the max-age of the JWKS: 1h
+const intervalKeyRotationCheck = time.Hour // check whether the signing key needs to be rotated: 1h
+const intervalKeyReload = time.Minute      // minimum interval to reload keys for an unknown kid: 1min
+
+// JWT signing keys, the newest active key signs tokens,
+// the retired keys only verify tokens.
+var jwtKeys *KeySet
+
+// SigningMethodEdDSA implements the EdDSA signing method with Ed25519, see RFC 8037
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+// JWTKey is an asymmetric key pair used to sign and verify JWT
+type JWTKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+}
+
+// PublicKey returns the public key used to verify JWT
+func (k *JWTKey) PublicKey() crypto.PublicKey {
+	return k.PrivateKey.Public()
+}
+
+// NewJWTKey generates a new key pair of the algorithm: RS256, ES256 or EdDSA
+func NewJWTKey(alg string) (*JWTKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningMethodEdDSA.Alg():
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("Unsupported signing algorithm: %v", alg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTKey{New16bitID(), jwt.GetSigningMethod(alg), privateKey}, nil
+}
+
+// parseJWTKey parses the key pair from the PKCS #8 PEM encoded private key
+func parseJWTKey(kid string, alg string, privatePEM string) (*JWTKey, error) {
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, errors.Errorf("Invalid PEM of the signing key %v", kid)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, errors.Errorf("Unsupported signing algorithm: %v", alg)
+	}
+
+	return &JWTKey{kid, method, privateKey.(crypto.Signer)}, nil
+}
+
+// readJWTKey reads the key pair from the PKCS #8 PEM file,
+// the algorithm is of the key type, and the kid is the hash of the public key,
+// which is the same on every whoam server and restart.
+func readJWTKey(filename string) (*JWTKey, error) {
+	privatePEM, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, errors.Errorf("Invalid PEM of the signing key %v", filename)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+
+	var method jwt.SigningMethod
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		if privateKey.Curve != elliptic.P256() {
+			return nil, errors.Errorf("Unsupported curve of the signing key %v: %v", filename, privateKey.Curve.Params().Name)
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		method = SigningMethodEdDSA
+	default:
+		return nil, errors.Errorf("Unsupported type of the signing key %v", filename)
+	}
+
+	signer := privateKey.(crypto.Signer)
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &JWTKey{base64.RawURLEncoding.EncodeToString(sum[:12]), method, signer}, nil
+}
+
+// MarshalPEM returns the PKCS #8 PEM encoded private key
+func (k *JWTKey) MarshalPEM() (string, error) {
+	bytes, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bytes})), nil
+}
+
+// JWK returns the public key as a JSON Web Key, see RFC 7517 and RFC 8037
+func (k *JWTKey) JWK() map[string]string {
+	jwk := map[string]string{
+		"kid": k.ID,
+		"use": "sig",
+		"alg": k.Method.Alg(),
+	}
+
+	switch publicKey := k.PublicKey().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = publicKey.Curve.Params().Name
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size)))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+
+	return jwk
+}
+
+// KeySet holds the signing key and all verification keys
+type KeySet struct {
+	sync.RWMutex
+	signingKey *JWTKey
+	keys       map[string]*JWTKey
+	loadedAt   time.Time
+
+	// reload is called to load the keys of an unknown kid, it may be nil
+	reload func() error
+	// reloading allows only one reload at a time, the others wait for its keys
+	reloading sync.Mutex
+}
+
+// NewKeySet returns a key set, the first key is the signing key
+func NewKeySet(keys ...*JWTKey) *KeySet {
+	ks := &KeySet{}
+	ks.set(keys...)
+	return ks
+}
+
+func (ks *KeySet) set(keys ...*JWTKey) {
+	ks.Lock()
+	defer ks.Unlock()
+
+	ks.signingKey = nil
+	ks.keys = make(map[string]*JWTKey)
+	for _, key := range keys {
+		if ks.signingKey == nil {
+			ks.signingKey = key
+		}
+		ks.keys[key.ID] = key
+	}
+	ks.loadedAt = time.Now()
+}
+
+// SigningKey returns the key which signs new tokens
+func (ks *KeySet) SigningKey() *JWTKey {
+	ks.RLock()
+	defer ks.RUnlock()
+	return ks.signingKey
+}
+
+// Key returns the verification key of the kid.
+// If the kid is unknown, the keys are reloaded at most once per intervalKeyReload,
+// the key may be created by another whoam server.
+func (ks *KeySet) Key(kid string) (*JWTKey, bool) {
+	ks.RLock()
+	key, ok := ks.keys[kid]
+	stale := ks.reload != nil && time.Since(ks.loadedAt) > intervalKeyReload
+	ks.RUnlock()
+
+	if ok || !stale {
+		return key, ok
+	}
+
+	ks.reloading.Lock()
+	defer ks.reloading.Unlock()
+
+	// The keys may be reloaded while waiting
+	ks.RLock()
+	key, ok = ks.keys[kid]
+	stale = time.Since(ks.loadedAt) > intervalKeyReload
+	ks.RUnlock()
+
+	if ok || !stale {
+		return key, ok
+	}
+
+	if err := ks.reload(); err != nil {
+		return nil, false
+	}
+
+	ks.RLock()
+	defer ks.RUnlock()
+	key, ok = ks.keys[kid]
+	return key, ok
+}
+
+// Keys returns all verification keys, sorted by kid
+func (ks *KeySet) Keys() []*JWTKey {
+	ks.RLock()
+	defer ks.RUnlock()
+
+	keys := make([]*JWTKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// InitKeys initialize the JWT signing keys,
+// and rotates the signing key periodically.
+// If the key files are configured, the keys are read from them and never rotated,
+// replace the files and restart whoam to rotate them.
+func InitKeys() {
+	if "" != config.KeyFile {
+		keys := []*JWTKey{}
+		for _, filename := range strings.Split(config.KeyFile, ",") {
+			key, err := readJWTKey(strings.TrimSpace(filename))
+			if err != nil {
+				panic("failed to read signing keys: " + err.Error())
+			}
+			keys = append(keys, key)
+		}
+		jwtKeys = NewKeySet(keys...)
+		return
+	}
+
+	jwtKeys = &KeySet{reload: loadKeys}
+
+	if err := rotateKeys(); err != nil {
+		panic("failed to initialize signing keys: " + err.Error())
+	}
+
+	go func() {
+		for range time.Tick(intervalKeyRotationCheck) {
+			// If failed, try again at the next check, the current signing key is still valid
+			if err := rotateKeys(); err != nil {
+				log.Println("failed to rotate signing keys:", err)
+			}
+		}
+	}()
+}
+
+// rotateKeys creates a new signing key if there is no active key,
+// the newest key is older than the rotation period or isn't of the configured algorithm.
+// The new key is published in the JWKS for timeoutKeyPublish before it signs tokens,
+// then the previous active keys are retired, and are deleted after timeoutRetiredKey.
+func rotateKeys() error {
+	rotation := time.Duration(config.KeyRotation) * 24 * time.Hour
+
+	active, err := client.SigningKey.Query().
+		Where(signingkey.RetiredAtIsNil()).
+		Order(ent.Desc(signingkey.FieldCreatedAt)).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	if 0 == len(active) || string(active[0].Algorithm) != config.SigningAlg || time.Since(active[0].CreatedAt) > rotation {
+		key, err := NewJWTKey(config.SigningAlg)
+		if err != nil {
+			return err
+		}
+
+		privatePEM, err := key.MarshalPEM()
+		if err != nil {
+			return err
+		}
+
+		_key, err := client.SigningKey.Create().
+			SetID(key.ID).
+			SetAlgorithm(signingkey.Algorithm(config.SigningAlg)).
+			SetPrivateKey(privatePEM).
+			Save(ctx)
+		if err != nil {
+			return err
+		}
+		active = append([]*ent.SigningKey{_key}, active...)
+	}
+
+	_, err = client.SigningKey.Update().
+		Where(signingkey.RetiredAtIsNil(), signingkey.CreatedAtLT(signingKeyOf(active).CreatedAt)).
+		SetRetiredAt(time.Now()).
+		Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.SigningKey.Delete().
+		Where(signingkey.RetiredAtLT(time.Now().Add(-timeoutRetiredKey))).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return loadKeys()
+}
+
+// signingKeyOf returns the signing key of the active keys sorted by created_at desc,
+// which is the newest key published for timeoutKeyPublish, so the services caching the JWKS have it.
+// If none is published long enough, such as the first key, the oldest active key signs tokens.
+func signingKeyOf(active []*ent.SigningKey) *ent.SigningKey {
+	for _, _key := range active {
+		if time.Since(_key.CreatedAt) >= timeoutKeyPublish {
+			return _key
+		}
+	}
+	return active[len(active)-1]
+}
+
+// loadKeys loads all signing keys from the database into jwtKeys
+func loadKeys() error {
+	_keys, err := client.SigningKey.Query().
+		Order(ent.Desc(signingkey.FieldCreatedAt)).
+		All(ctx)
+	if err != nil {
+		return err
+	}
+
+	active := []*ent.SigningKey{}
+	for _, _key := range _keys {
+		if nil == _key.RetiredAt {
+			active = append(active, _key)
+		}
+	}
+	if 0 == len(active) {
+		return errors.New("No active signing key")
+	}
+
+	// The signing key is the first key of the key set
+	signing := signingKeyOf(active)
+	keys := make([]*JWTKey, 1, len(_keys))
+	for _, _key := range _keys {
+		key, err := parseJWTKey(_key.ID, string(_key.Algorithm), _key.PrivateKey)
+		if err != nil {
+			return err
+		}
+		if _key == signing {
+			keys[0] = key
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	jwtKeys.set(keys...)
+
+	return nil
+}
+
+// GetJWKS returns the public keys to verify whoam tokens, see RFC 7517 §5
+func GetJWKS(c *Context) error {
+	keys := jwtKeys.Keys()
+
+	jwks := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		jwks[i] = key.JWK()
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(timeoutKeyPublish.Seconds())))
+
+	return c.Ok(struct {
+		Keys []map[string]string `json:"keys"`
+	}{
+		Keys: jwks,
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"whoam.xyz/ent/signingkey"
+)
+
+// publicKeyOfJWK returns the public key of the JSON Web Key
+func publicKeyOfJWK(t *testing.T, jwk map[string]string) interface{} {
+	decode := func(member string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(jwk[member])
+		if err != nil || 0 == len(b) {
+			t.Fatalf("invalid JWK member %v: %v", member, jwk[member])
+		}
+		return b
+	}
+
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "EC":
+		x, y := decode("x"), decode("y")
+		if "P-256" != jwk["crv"] || 32 != len(x) || 32 != len(y) {
+			t.Fatal("the EC JWK should be of P-256", jwk)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		if "Ed25519" != jwk["crv"] {
+			t.Fatal("the OKP JWK should be of Ed25519", jwk)
+		}
+		return ed25519.PublicKey(decode("x"))
+	}
+
+	t.Fatal("unknown JWK type", jwk)
+	return nil
+}
+
+func TestJWK(t *testing.T) {
+	types := map[string]string{"RS256": "RSA", "ES256": "EC", "EdDSA": "OKP"}
+
+	for alg, kty := range types {
+		key, err := NewJWTKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jwk := key.JWK()
+		if kty != jwk["kty"] || alg != jwk["alg"] || key.ID != jwk["kid"] || "sig" != jwk["use"] {
+			t.Error("the JWK should describe the key", alg, jwk)
+		}
+
+		// The token signed by the key is verified by the public key of the JWK
+		signed, err := jwt.NewWithClaims(key.Method, jwt.StandardClaims{Subject: "jwk"}).SignedString(key.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey := publicKeyOfJWK(t, jwk)
+		_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) { return publicKey, nil })
+		if err != nil {
+			t.Error("the public key of the JWK should verify the token", alg, err)
+		}
+
+		privatePEM, err := key.MarshalPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parseJWTKey(key.ID, alg, privatePEM)
+		if err != nil || parsed.JWK()["x"] != jwk["x"] || parsed.JWK()["n"] != jwk["n"] {
+			t.Error("the parsed key should be the same key", alg, err)
+		}
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	setupOAuth(t)
+
+	defer func(alg string, rotation int) {
+		config.SigningAlg, config.KeyRotation = alg, rotation
+	}(config.SigningAlg, config.KeyRotation)
+	config.SigningAlg, config.KeyRotation = "ES256", 30
+
+	if _, err := client.SigningKey.Delete().Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys = &KeySet{reload: loadKeys}
+
+	if err := rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	first := jwtKeys.SigningKey()
+	if first == nil || "ES256" != first.Method.Alg() {
+		t.Fatal("a signing key of the configured algorithm should be created", first)
+	}
+
+	if err := rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != jwtKeys.SigningKey().ID {
+		t.Error("the active key shouldn't be rotated before the rotation period")
+	}
+
+	accessToken, err := NewJWTToken(0, exampleService, "", "", time.Hour, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key of another algorithm is published before it signs tokens
+	config.SigningAlg = "EdDSA"
+	if err = rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != jwtKeys.SigningKey().ID || 2 != len(jwtKeys.Keys()) {
+		t.Fatal("the new key should be published, the active key still signs tokens", len(jwtKeys.Keys()))
+	}
+	next, err := client.SigningKey.Query().Where(signingkey.IDNEQ(first.ID)).Only(ctx)
+	if err != nil || signingkey.AlgorithmEdDSA != next.Algorithm || nil != next.RetiredAt {
+		t.Fatal("a new key of the configured algorithm should be created", next, err)
+	}
+	if err = rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != jwtKeys.SigningKey().ID || 2 != len(jwtKeys.Keys()) {
+		t.Error("the published key shouldn't be rotated again", len(jwtKeys.Keys()))
+	}
+
+	// The published key signs tokens after the JWKS max-age, the previous key is retired
+	// and still verifies tokens
+	_keys, err := client.SigningKey.Query().All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, _key := range _keys {
+		// created_at is immutable, the key is created again an hour ago
+		createdAt := time.Now().Add(-timeoutKeyPublish - time.Minute)
+		if first.ID == _key.ID {
+			createdAt = createdAt.Add(-time.Hour)
+		}
+		if err = client.SigningKey.DeleteOne(_key).Exec(ctx); err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.SigningKey.Create().
+			SetID(_key.ID).
+			SetAlgorithm(_key.Algorithm).
+			SetPrivateKey(_key.PrivateKey).
+			SetCreatedAt(createdAt).
+			Save(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != jwtKeys.SigningKey().ID || "EdDSA" != jwtKeys.SigningKey().Method.Alg() {
+		t.Error("the published key should sign tokens")
+	}
+	if retired, err := client.SigningKey.Get(ctx, first.ID); err != nil || nil == retired.RetiredAt {
+		t.Error("the previous key should be retired", err)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err != nil {
+		t.Error("the retired key should verify tokens within the retention", err)
+	}
+
+	// The retired key is deleted after the retention
+	_, err = client.SigningKey.Update().
+		Where(signingkey.IDEQ(first.ID)).
+		SetRetiredAt(time.Now().Add(-timeoutRetiredKey - time.Minute)).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rotateKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jwtKeys.Key(first.ID); ok {
+		t.Error("the retired key should be dropped after the retention")
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err == nil {
+		t.Error("the token of the dropped key should be rejected")
+	}
+	if 1 != len(jwtKeys.Keys()) {
+		t.Error("only the active key should be kept", len(jwtKeys.Keys()))
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	known, err := NewJWTKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := NewJWTKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := NewKeySet(known)
+	reloads := 0
+	ks.reload = func() error {
+		reloads++
+		ks.set(created, known)
+		return nil
+	}
+
+	if _, ok := ks.Key(known.ID); !ok || 0 != reloads {
+		t.Error("the known key shouldn't reload", reloads)
+	}
+	if _, ok := ks.Key(created.ID); ok || 0 != reloads {
+		t.Error("the keys shouldn't be reloaded within the reload interval", reloads)
+	}
+
+	// The key created by another server is loaded for its unknown kid
+	ks.loadedAt = time.Now().Add(-intervalKeyReload - time.Second)
+	if key, ok := ks.Key(created.ID); !ok || created != key || 1 != reloads {
+		t.Error("the unknown kid should reload the keys", reloads)
+	}
+	if created != ks.SigningKey() {
+		t.Error("the reloaded signing key should be used")
+	}
+
+	if _, ok := ks.Key("unknown"); ok || 1 != reloads {
+		t.Error("the keys shouldn't be reloaded again within the reload interval", reloads)
+	}
+
+	// The concurrent lookups of an unknown kid reload the keys once
+	ks.loadedAt = time.Now().Add(-intervalKeyReload - time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks.Key("unknown")
+		}()
+	}
+	wg.Wait()
+	if 2 != reloads {
+		t.Error("the concurrent lookups should reload the keys once", reloads)
+	}
+}
+
+func TestReadJWTKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whoam-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := NewJWTKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privatePEM, err := key.MarshalPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, alg+".pem")
+		if err = ioutil.WriteFile(filename, []byte(privatePEM), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := readJWTKey(filename)
+		if err != nil || alg != read.Method.Alg() || read.JWK()["x"] != key.JWK()["x"] || read.JWK()["n"] != key.JWK()["n"] {
+			t.Error("the key of the file should be read with its algorithm", alg, err)
+			continue
+		}
+		again, _ := readJWTKey(filename)
+		if "" == read.ID || again.ID != read.ID {
+			t.Error("the kid of the key file should be stable", read.ID, again.ID)
+		}
+	}
+
+	if _, err = readJWTKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("the missing key file should fail")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"html/template"
 	"strconv"
 	"time"
 
@@ -18,14 +17,55 @@ type Config struct {
 	Port  int    `flag:"Authorization server port"`
 	Db    string `flag:"Authorization database file path"`
 	Debug bool   `flag:"Is Debug mode"`
+
+	SecretOverlap int    `flag:"Hours the previous client secret remains valid after rotation"`
+	SigningAlg    string `flag:"JWT signing algorithm: RS256, ES256 or EdDSA"`
+	KeyRotation   int    `flag:"Days between JWT signing key rotations"`
+	KeyFile       string `flag:"Comma-separated PKCS #8 PEM files of the JWT signing keys instead of the rotated keys of the database, the first signs tokens and the others only verify them"`
+	Issuer        string `flag:"Issuer identifier of whoam, the external URL such as https://whoam.xyz"`
+	Store         string `flag:"Storage of verification codes and OAuth codes: memory, db or redis://[:password@]host:port[/db]"`
+	Mailer        string `flag:"Mailer of emails: stdout, relay (the ses server), file:<dir>, smtp://[user:password@]host[:port][?auth=plain|login&starttls=required|optional] (STARTTLS, required except for localhost) or smtps://... (implicit TLS)"`
+	MailFrom      string `flag:"Sender address of emails, such as WHOAM <noreply@whoam.xyz>"`
+	Admins        string `flag:"Comma-separated emails of the administrators"`
+	Locale        string `flag:"Default locale if the user's languages aren't supported: en or zh-CN"`
+	TemplateDir   string `flag:"Directory of the templates overriding the built-in templates of the same name, such as oauth.html or mail/verification.html"`
+
+	AllowedOrigins string `flag:"Comma-separated origins of the web UI allowed by CORS with cookies, the domains of the verified services are allowed only by the token and userinfo endpoints"`
+
+	SubjectType    string `flag:"Subject identifier type of the services which don't choose one: public (the user ID) or pairwise (unique per service)"`
+	PairwiseSecret string `flag:"Secret of the pairwise subject identifiers, generated and kept in the database if empty; changing it changes the pairwise subjects"`
+
+	SessionIdleTimeout int `flag:"Minutes after which an unused browser session is ended"`
+	SessionLifetime    int `flag:"Hours after which a browser session is ended, however active it is"`
+
+	MailWorkers     int `flag:"Number of workers sending the queued emails"`
+	MailMaxAttempts int `flag:"Failed attempts after which a queued email is dead"`
+
+	CodeEntropy      int `flag:"Bits of entropy of the email verification code"`
+	OAuthCodeEntropy int `flag:"Bits of entropy of the OAuth authorization code, at least 128"`
+	TokenEntropy     int `flag:"Bits of entropy of the refresh token, at least 128"`
+
+	MaxCodeAttempts int `flag:"Failed attempts after which the email verification code is invalidated"`
+	RateLimitWindow int `flag:"Minutes of the sliding window of the login rate limits"`
+	RateLimitEmail  int `flag:"Maximum login requests per email within the rate limit window, of each whoam server"`
+	RateLimitIP     int `flag:"Maximum login requests per client IP within the rate limit window, of each whoam server"`
+
+	TrustProxy bool `flag:"Trust the X-Forwarded-For and X-Real-IP headers for the client IP, only if whoam is behind a reverse proxy which sets them"`
 }
 
 const (
-	tlpUserLogin = "login.html"
-	tlpUserOAuth = "oauth.html"
+	tlpUserLogin   = "login.html"
+	tlpUserOAuth   = "oauth.html"
+	tlpUserApprove = "approve.html"
+	tlpUserAccount = "account.html"
+
+	tlpMailVerification = "mail/verification.html"
+	tlpMailEmail        = "mail/email.html"
 
 	// MainServiceID main servvice id
 	MainServiceID = "whoam.xyz"
+
+	minTokenEntropy = 128 // minimum bits of entropy of OAuth codes and refresh tokens
 )
 
 var config Config
@@ -34,7 +74,11 @@ var client *ent.Client
 var router *gin.Engine
 
 func init() {
-	config = Config{Port: 8030, Db: "test.db", Debug: false}
+	config = Config{Port: 8030, Db: "test.db", Debug: false, SecretOverlap: 24, SigningAlg: "RS256", KeyRotation: 30, Store: "memory", Locale: "en", SubjectType: "public",
+		Mailer: "stdout", MailFrom: "WHOAM <noreply@whoam.xyz>",
+		MailWorkers: 2, MailMaxAttempts: 5, SessionIdleTimeout: 120, SessionLifetime: 168,
+		CodeEntropy: 20, OAuthCodeEntropy: 160, TokenEntropy: 384,
+		MaxCodeAttempts: 5, RateLimitWindow: 15, RateLimitEmail: 10, RateLimitIP: 50}
 
 	goflag.Var(&config)
 }
@@ -42,6 +86,11 @@ func init() {
 func main() {
 	goflag.Parse("config", "Configuration file path")
 
+	// Guessing an OAuth code or a refresh token must be infeasible, see RFC 6749 §10.10
+	if config.OAuthCodeEntropy < minTokenEntropy || config.TokenEntropy < minTokenEntropy {
+		panic("the entropy of OAuth codes and refresh tokens must be at least " + strconv.Itoa(minTokenEntropy) + " bits")
+	}
+
 	time.FixedZone("CST", 8*3600)
 
 	var err error
@@ -66,65 +115,119 @@ func main() {
 		panic("failed to create schema: " + err.Error())
 	}
 
+	InitI18n()
+	InitStore()
+	InitMailer()
+	InitKeys()
 	InitUser()
+	InitEmail()
+	InitSession()
 	InitService()
-
-	tmpl := template.New("user")
-	box := packr.NewBox("./html")
-
-	for _, v := range box.List() {
-		indexTmpl := tmpl.New(v)
-		data, _ := box.FindString(v)
-		indexTmpl.Parse(data)
-	}
+	InitSubject()
+	InitDomainVerification()
+	InitOutbox()
 
 	router = gin.Default()
-	router.SetHTMLTemplate(tmpl)
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, ResponseType, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
+	router.ForwardedByClientIP = config.TrustProxy
+	router.Use(Localize)
 	router.StaticFS("/favicon_io", packr.NewBox("./favicon_io"))
 	router.StaticFS("/js", packr.NewBox("./res/js"))
 	router.StaticFS("/css", packr.NewBox("./res/css"))
 
+	wellKnownRouter := router.Group("/.well-known")
+	openCORS.Apply(wellKnownRouter)
+	{
+		wellKnownRouter.GET("/jwks.json", handle(GetJWKS))
+		wellKnownRouter.GET("/openid-configuration", handle(GetOpenIDConfiguration))
+	}
+
+	userInfoRouter := router.Group("/userinfo")
+	serviceCORS.Apply(userInfoRouter)
+	{
+		userInfoRouter.GET("", handle(GetUserInfo))
+		userInfoRouter.POST("", handle(GetUserInfo))
+	}
+
 	authorized := router.Group("/")
 	authorized.Use(AuthRequired)
 	{
 		// Web page
 		authorized.GET("/user/login", handle(loginEndpoint))
 		authorized.GET("/user/oauth", handle(oauthEndpoint))
+		authorized.GET("/oauth/authorize", handle(authorizeEndpoint))
+		authorized.GET("/user/account", handle(accountEndpoint))
+	}
+
+	router.GET("/user/approve", handle(approveEndpoint))
+
+	tokenRouter := router.Group("/oauth")
+	serviceCORS.Apply(tokenRouter)
+	{
+		tokenRouter.POST("/token", handle(PostOAuthToken))
+		tokenRouter.POST("/revoke", handle(PostOAuthRevoke))
+		tokenRouter.POST("/introspect", handle(PostOAuthIntrospect))
 	}
 
+	// The APIs of the web UI use the session cookie, but the legacy OAuth APIs are called by the services
 	v1 := router.Group("/api/v1")
 	{
 		mainRouter := v1.Group("/user/main")
+		restrictedCORS.Apply(mainRouter)
 		{
 			mainRouter.POST("/code", handle(PostMainCode))
 			mainRouter.POST("/auth", handle(PostMainAuth))
+			mainRouter.POST("/approve", handle(PostMainApprove))
+			mainRouter.POST("/status", handle(PostMainStatus))
+			mainRouter.POST("/logout", handle(PostMainLogout))
+			mainRouter.POST("/logout/all", handle(PostMainLogoutAll))
 		}
 
 		oauthRouter := v1.Group("/user/oauth")
 		{
-			oauthRouter.POST("/auth", handle(PostUserOAuthAuth))
-			oauthRouter.POST("/refresh", handle(PostUserOAuthRefresh))
+			restrictedCORS.Route(oauthRouter, "POST", "/auth", handle(PostUserOAuthAuth))
+			serviceCORS.Route(oauthRouter, "POST", "/refresh", handle(PostUserOAuthRefresh))
+
+			serviceCORS.Route(oauthRouter, "GET", "/base", handle(GetUser))
+			serviceCORS.Route(oauthRouter, "GET", "/token", handle(GetOAuthCode))
+			serviceCORS.Route(oauthRouter, "GET", "/state", handle(GetOAuthState))
+		}
 
-			oauthRouter.GET("/base", handle(GetUser))
-			oauthRouter.GET("/token", handle(GetOAuthCode))
-			oauthRouter.GET("/state", handle(GetOAuthState))
+		accountRouter := v1.Group("/user/account")
+		restrictedCORS.Apply(accountRouter)
+		{
+			accountRouter.GET("/services", handle(GetAccountServices))
+			accountRouter.DELETE("/services/:id", handle(DeleteAccountService))
+			accountRouter.DELETE("/authorizations/:id", handle(DeleteAccountAuthorization))
+			accountRouter.GET("/sessions", handle(GetAccountSessions))
+			accountRouter.DELETE("/sessions/:id", handle(DeleteAccountSession))
+			accountRouter.GET("/profile", handle(GetAccountProfile))
+			accountRouter.PATCH("/profile", handle(PatchAccountProfile))
+			accountRouter.GET("/emails", handle(GetAccountEmails))
+			accountRouter.POST("/emails", handle(PostAccountEmail))
+			accountRouter.POST("/emails/:id/verify", handle(PostAccountEmailVerify))
+			accountRouter.POST("/emails/:id/primary", handle(PostAccountEmailPrimary))
+			accountRouter.DELETE("/emails/:id", handle(DeleteAccountEmail))
 		}
 
 		serviceRouter := v1.Group("/service")
+		restrictedCORS.Apply(serviceRouter)
 		{
 			serviceRouter.POST("/", handle(PostService))
+			serviceRouter.GET("/", handle(GetServices))
+			serviceRouter.GET("/:id", handle(GetService))
+			serviceRouter.PATCH("/:id", handle(PatchService))
+			serviceRouter.DELETE("/:id", handle(DeleteService))
+			serviceRouter.GET("/:id/verification", handle(GetServiceVerification))
+			serviceRouter.POST("/:id/verification", handle(PostServiceVerification))
+			serviceRouter.POST("/:id/secret", handle(PostServiceSecret))
+			serviceRouter.PUT("/:id/redirect_uris", handle(PutServiceRedirectURIs))
+		}
+
+		adminRouter := v1.Group("/admin")
+		restrictedCORS.Apply(adminRouter)
+		{
+			adminRouter.GET("/mails", handle(GetAdminMails))
+			adminRouter.POST("/mails/:id/resend", handle(PostAdminMailResend))
 		}
 	}
 
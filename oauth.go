@@ -1,31 +1,275 @@
 package main
 
 import (
+	"log"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
 	"whoam.xyz/ent/oauth"
-	"whoam.xyz/ent/user"
 )
 
 type userOAuth struct {
-	UserID   int    `json:"userId"`
-	ClientID string `json:"clientId"`
+	UserID      int    `json:"userId"`
+	ClientID    string `json:"clientId"`
+	RedirectURI string `json:"redirectUri" note:"The redirect_uri of the authorization request, it's empty if omitted"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
+	Scope    string `json:"scope,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	AuthTime int64  `json:"authTime" note:"The time when the user logged in to whoam"`
+
+	Family string `json:"family,omitempty" note:"The refresh token family issued from the code, it's set when the code is redeemed"`
+}
+
+const timeoutRedeemedCode = 24 * 60 * 60 // redeemed OAuth code is remembered to detect reuse: 1day
+
+var errInvalidOAuthCode = errors.New("Invalid code, please login again")
+var errInvalidRefreshToken = errors.New("Invalid refreshToken, please login again")
+
+// newOAuthToken creates a refresh token record of the user for the service with the granted scope,
+// it starts a new refresh token family, and signs a new access token for it
+func newOAuthToken(userID int, serviceID string, scope string) (string, *ent.Oauth, error) {
+	return newOAuthTokenInFamily(userID, serviceID, scope, New32bitID())
+}
+
+// newOAuthTokenInFamily is newOAuthToken which starts the given refresh token family,
+// a new family is started if it's empty
+func newOAuthTokenInFamily(userID int, serviceID string, scope string, family string) (string, *ent.Oauth, error) {
+	if "" == family {
+		family = New32bitID()
+	}
+
+	_service, err := client.Service.Get(ctx, serviceID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	auth, err := client.Oauth.Create().
+		SetMainToken(NewRefreshToken()).
+		SetExpiredAt(now.Add(timeoutRefreshToken)).
+		SetUserID(userID).
+		SetServiceID(serviceID).
+		SetScope(scope).
+		SetFamily(family).
+		SetAuthorizedAt(now).
+		Save(ctx)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	accessToken, err := newAccessToken(auth, userID, _service)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return accessToken, auth, nil
+}
+
+// newAccessToken signs a new access token of the refresh token record,
+// the `sid` claim of the access token is the family of the record, which is random and doesn't disclose the record.
+func newAccessToken(auth *ent.Oauth, userID int, _service *ent.Service) (string, error) {
+	return NewJWTToken(userID, _service, auth.Family, auth.Scope, timeoutAccessToken, jwtKeys.SigningKey())
+}
+
+// authorizedAtOf returns the time when the refresh token family was authorized
+func authorizedAtOf(auth *ent.Oauth) time.Time {
+	if auth.AuthorizedAt.IsZero() {
+		return auth.CreatedAt
+	}
+	return auth.AuthorizedAt
+}
+
+// revokeFamily revokes all refresh tokens rotated from the same authorization of the refresh token
+func revokeFamily(auth *ent.Oauth) error {
+	if "" == auth.Family {
+		return revokeOAuths(auth)
+	}
+
+	auths, err := client.Oauth.Query().Where(oauth.FamilyEQ(auth.Family)).All(ctx)
+	if err != nil {
+		return err
+	}
+
+	return revokeOAuths(auths...)
+}
+
+// refreshOAuthToken rotates the refresh token, the new refresh token is in the same family,
+// and signs a new access token for it.
+// If a rotated refresh token is presented again, it may be leaked, the whole family is revoked.
+// The family can't be refreshed beyond the max session lifetime of the service.
+// If clientID isn't empty, the refresh token must be issued to the client.
+func refreshOAuthToken(mainToken string, clientID string) (string, *ent.Oauth, error) {
+	auth, err := client.Oauth.Query().
+		Where(oauth.MainTokenEQ(mainToken)).
+		WithUser().
+		WithService().
+		Only(ctx)
+	if err != nil {
+		return "", nil, errInvalidRefreshToken
+	}
+
+	// A token of another client isn't a reuse of the family, it's rejected without revoking it
+	if "" != clientID && auth.Edges.Service.ID != clientID {
+		return "", nil, errInvalidRefreshToken
+	}
+
+	if nil != auth.RotatedAt {
+		if err = revokeFamily(auth); err != nil {
+			return "", nil, err
+		}
+		return "", nil, errInvalidRefreshToken
+	}
+
+	now := time.Now()
+	if auth.ExpiredAt.Before(now) {
+		return "", nil, errInvalidRefreshToken
+	}
+
+	authorizedAt := authorizedAtOf(auth)
+	expiredAt := now.Add(timeoutRefreshToken)
+	if lifetime := auth.Edges.Service.MaxSessionLifetime; 0 < lifetime {
+		deadline := authorizedAt.Add(time.Duration(lifetime) * time.Second)
+		if !deadline.After(now) {
+			return "", nil, errInvalidRefreshToken
+		}
+		if deadline.Before(expiredAt) {
+			expiredAt = deadline
+		}
+	}
+
+	family := auth.Family
+	if "" == family {
+		family = New32bitID()
+	}
+
+	var rotated *ent.Oauth
+	err = WithTx(ctx, client, func(tx *ent.Tx) error {
+		// Only one of the concurrent requests with the same refresh token can rotate it
+		n, err := tx.Oauth.Update().
+			Where(oauth.IDEQ(auth.ID)).
+			Where(oauth.RotatedAtIsNil()).
+			SetRotatedAt(now).
+			Save(ctx)
+		if err != nil {
+			return err
+		}
+		if 0 == n {
+			return errInvalidRefreshToken
+		}
+
+		rotated, err = tx.Oauth.Create().
+			SetMainToken(NewRefreshToken()).
+			SetExpiredAt(expiredAt).
+			SetUserID(auth.Edges.User.ID).
+			SetServiceID(auth.Edges.Service.ID).
+			SetScope(auth.Scope).
+			SetFamily(family).
+			SetAuthorizedAt(authorizedAt).
+			Save(ctx)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	rotated.Edges = auth.Edges
+
+	accessToken, err := newAccessToken(rotated, auth.Edges.User.ID, auth.Edges.Service)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return accessToken, rotated, nil
+}
+
+// issueOAuthCode issues a new authorization code of the authorization information
+func issueOAuthCode(oauthUser *userOAuth) (string, error) {
+	code := NewOAuthCode()
+	if err := oauthCodeBox.SetVal(code, oauthUser); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// redeemOAuthCode returns the authorization information of the code,
+// the code can only be redeemed once, even by concurrent requests.
+// The redeemed code is remembered with the refresh token family to be issued from it,
+// if it's presented again, all tokens issued from it are revoked, see RFC 6749 §4.1.2.
+func redeemOAuthCode(code string) (*userOAuth, error) {
+	var oauthUser userOAuth
+
+	err := oauthCodeBox.TakeVal(code, &oauthUser)
+	if err != nil {
+		if err = revokeRedeemedCode(code); err != nil {
+			log.Println("failed to revoke tokens of the reused code:", err)
+		}
+		return nil, errInvalidOAuthCode
+	}
+
+	oauthUser.Family = New32bitID()
+	err = oauthCodeBox.SetStringVal("redeemed:"+code, oauthUser.Family, timeoutRedeemedCode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauthUser, nil
+}
+
+// peekOAuthCode returns the authorization information of the code without redeeming it,
+// so that the token request is validated before the code is used up.
+// If the code has been redeemed, it's redeemed again to revoke the tokens issued from it.
+func peekOAuthCode(code string) (*userOAuth, error) {
+	var oauthUser userOAuth
+	if err := oauthCodeBox.Val(code, &oauthUser); err != nil {
+		if _, err = redeemOAuthCode(code); err == nil {
+			err = errInvalidOAuthCode
+		}
+		return nil, err
+	}
+
+	return &oauthUser, nil
+}
+
+// revokeRedeemedCode revokes the refresh token family issued from the code, if the code has been redeemed
+func revokeRedeemedCode(code string) error {
+	family, err := oauthCodeBox.StringVal("redeemed:" + code)
+	if err != nil {
+		return nil
+	}
+
+	auths, err := client.Oauth.Query().Where(oauth.FamilyEQ(family)).All(ctx)
+	if err != nil {
+		return err
+	}
+
+	return revokeOAuths(auths...)
+}
+
+// verifyLegacyClient reports whether the request of the legacy API is authenticated as the service,
+// only the confidential service needs to authenticate.
+func verifyLegacyClient(c *Context, _service *ent.Service) bool {
+	if !isConfidential(_service) {
+		return true
+	}
+
+	id, secret, _, e := clientCredentials(c)
+	return e == nil && id == _service.ID && verifyClientSecret(_service, secret)
 }
 
 // GetOAuthState Get user authorization status
 func GetOAuthState(c *Context) error {
-	accessToken, _ := c.Cookie("accessToken")
+	accessToken := accessTokenOf(c)
 	if "" == accessToken {
-		accessToken = c.GetHeader("Authorization")
-		if "" == accessToken {
-			return c.Unauthorized("Unauthorized")
-		}
-	} else if accessToken != c.GetHeader("Authorization") {
-		// 冲突
-		return c.Conflict("Cookie's accessToken and Header's Authorization value are inconsistent")
+		return c.Unauthorized("Unauthorized")
 	}
 
-	_, err := FilterJWTToken(accessToken, signingKey)
+	_, err := FilterJWTToken(accessToken, jwtKeys)
 	if err != nil {
 		return c.Unauthorized(err.Error())
 	}
@@ -33,67 +277,108 @@ func GetOAuthState(c *Context) error {
 	return c.NoContent()
 }
 
-// GetUser is used to get the basic information of the user, if authenticated through OAuth
+// GetUser is used to get the basic information of the user granted by the scope, if authenticated through OAuth
 func GetUser(c *Context) error {
-	accessToken, _ := c.Cookie("accessToken")
+	accessToken := accessTokenOf(c)
 	if "" == accessToken {
-		accessToken = c.GetHeader("Authorization")
-		if "" == accessToken {
-			return c.Unauthorized("Unauthorized")
-		}
-	} else if accessToken != c.GetHeader("Authorization") {
-		// 冲突
-		return c.Conflict("Cookie's accessToken and Header's Authorization value are inconsistent")
+		return c.Unauthorized("Unauthorized")
 	}
 
-	_claims, err := FilterJWTToken(accessToken, signingKey)
+	_claims, err := FilterJWTToken(accessToken, jwtKeys)
 	if err != nil {
 		return c.Unauthorized(err.Error())
 	}
 
-	_user, err := client.User.Query().Where(user.IDEQ(int(_claims.OtherID))).Only(ctx)
+	_user, err := userOfClaims(_claims)
+	if err == errNoTokenUser {
+		return c.Unauthorized(err.Error())
+	}
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
+	// The tokens of the legacy API have no scope, they have the email as before scopes
+	claims := profileClaimsOf(_user, _claims.Scope)
+	if "" == _claims.Scope {
+		claims.Email = _user.Email
+	}
+
+	// The user ID is only known by the services of public subjects
 	return c.Ok(
 		struct {
-			ID    int    `json:"id"`
-			Email string `json:"email"`
+			ID      int    `json:"id,omitempty"`
+			Subject string `json:"sub"`
+			ProfileClaims
 		}{
-			ID:    _user.ID,
-			Email: _user.Email,
+			ID:            int(_claims.OtherID),
+			Subject:       _claims.Subject,
+			ProfileClaims: claims,
 		})
 }
 
 // PostUserOAuthAuth whoam user authorized the request(/user/oauth/auth request)
 func PostUserOAuthAuth(c *Context) error {
 	var form struct {
-		MainToken string `json:"mainToken" binding:"required"`
-		ClientID  string `json:"clientId" binding:"required"`
-		State     string `json:"state" binding:"required"`
+		ClientID    string `json:"clientId" binding:"required"`
+		RedirectURI string `json:"redirectUri"`
+
+		CodeChallenge       string `json:"codeChallenge"`
+		CodeChallengeMethod string `json:"codeChallengeMethod"`
+
+		Scope string `json:"scope"`
+		Nonce string `json:"nonce"`
 	}
 	err := c.ShouldBindJSON(&form)
 	if err != nil {
 		return c.BadRequest(err.Error())
 	}
 
-	owner, err := client.Oauth.Query().Where(oauth.MainTokenEQ(form.MainToken)).QueryUser().Only(ctx)
+	_service, err := client.Service.Get(ctx, form.ClientID)
+	if err != nil {
+		return c.BadRequest("Invalid clientId: %v", form.ClientID)
+	}
+
+	if _, ok := matchRedirectURI(_service, form.RedirectURI); !ok {
+		return c.BadRequest("Unregistered redirectUri: %v", form.RedirectURI)
+	}
+
+	method, oe := checkCodeChallenge(_service, form.CodeChallenge, form.CodeChallengeMethod)
+	if oe != nil {
+		return c.BadRequest(oe.Description)
+	}
+
+	scopes, oe := checkScope(_service, form.Scope)
+	if oe != nil {
+		return c.BadRequest(oe.Description)
+	}
+
+	_session, err := csrfSessionOf(c)
 	if err != nil {
-		return c.Unauthorized("Invalid token, please login again")
+		return c.Unauthorized(err.Error())
 	}
+	owner := _session.Edges.User
 
 	oauthUser := userOAuth{
-		UserID:   owner.ID,
-		ClientID: form.ClientID,
+		UserID:      owner.ID,
+		ClientID:    form.ClientID,
+		RedirectURI: form.RedirectURI,
+
+		CodeChallenge:       form.CodeChallenge,
+		CodeChallengeMethod: method,
+
+		Scope:    strings.Join(scopes, " "),
+		Nonce:    form.Nonce,
+		AuthTime: _session.CreatedAt.Unix(),
 	}
 
-	code := New32bitID()
-	if err = oauthCodeBox.SetVal(code, &oauthUser); err != nil {
+	if err = saveGrant(owner.ID, _service.ID, scopes); err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	err = oauthCodeBox.Val(code, &oauthUser)
+	code, err := issueOAuthCode(&oauthUser)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
 
 	return c.Ok(code)
 }
@@ -105,27 +390,30 @@ func GetOAuthCode(c *Context) error {
 		return c.BadRequest("code is empty")
 	}
 
-	var oauthUser userOAuth
-
-	err := oauthCodeBox.Val(code, &oauthUser)
+	peek, err := peekOAuthCode(code)
 	if err != nil {
-		return c.Unauthorized("Invalid token, please login again")
+		return c.Unauthorized(err.Error())
 	}
 
-	oauthCodeBox.DelString(code)
+	_service, err := client.Service.Get(ctx, peek.ClientID)
+	if err != nil || !verifyLegacyClient(c, _service) {
+		return c.Unauthorized("Client authentication failed")
+	}
 
-	accessToken, err := NewJWTToken(oauthUser.UserID, oauthUser.ClientID, timeoutAccessToken, signingKey)
-	if err != nil {
-		return c.InternalServerError(err.Error())
+	if peek.RedirectURI != c.Query("redirect_uri") {
+		return c.Unauthorized("The redirect_uri doesn't match the authorization request")
 	}
 
-	auth, err := client.Oauth.Create().
-		SetMainToken(New64BitID()).
-		SetExpiredAt(time.Now().Add(timeoutRefreshToken)).
-		SetUserID(oauthUser.UserID).
-		SetServiceID(oauthUser.ClientID).
-		Save(ctx)
+	if oe := verifyCodeVerifier(peek, c.Query("code_verifier")); oe != nil {
+		return c.Unauthorized(oe.Description)
+	}
+
+	oauthUser, err := redeemOAuthCode(code)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
 
+	accessToken, auth, err := newOAuthTokenInFamily(oauthUser.UserID, oauthUser.ClientID, oauthUser.Scope, oauthUser.Family)
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
@@ -140,7 +428,7 @@ func GetOAuthCode(c *Context) error {
 		})
 }
 
-// PostUserOAuthRefresh refresh user access token
+// PostUserOAuthRefresh refresh user access token, the refresh token is rotated
 func PostUserOAuthRefresh(c *Context) error {
 	var _body struct {
 		MainToken string `json:"mainToken" binding:"required"`
@@ -150,34 +438,29 @@ func PostUserOAuthRefresh(c *Context) error {
 		return c.BadRequest(err.Error())
 	}
 
-	auth, err := client.Oauth.Query().
-		Where(oauth.MainTokenEQ(_body.MainToken)).
-		Where(oauth.ExpiredAtGT(time.Now())).
-		Only(ctx)
+	_service, err := client.Oauth.Query().Where(oauth.MainTokenEQ(_body.MainToken)).QueryService().Only(ctx)
 	if err != nil {
-		return c.Unauthorized("Invalid refreshToken, please login again")
+		return c.Unauthorized(errInvalidRefreshToken.Error())
 	}
 
-	authUser, err := auth.QueryUser().Only(ctx)
-	if err != nil {
-		return c.Unauthorized("Invalid authorized user, please login again")
+	if !verifyLegacyClient(c, _service) {
+		return c.Unauthorized("Client authentication failed")
 	}
 
-	authService, err := auth.QueryService().Only(ctx)
-	if err != nil {
-		return c.Unauthorized("Invalid authorized service, please login again")
+	accessToken, auth, err := refreshOAuthToken(_body.MainToken, _service.ID)
+	if err == errInvalidRefreshToken {
+		return c.Unauthorized(err.Error())
 	}
-
-	accessToken, err := NewJWTToken(authUser.ID, authService.ID, timeoutAccessToken, signingKey)
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	_, err = auth.Update().SetExpiredAt(time.Now().Add(timeoutRefreshToken)).Save(ctx)
-
-	if err != nil {
-		return c.InternalServerError(err.Error())
-	}
-
-	return c.Ok(accessToken)
+	return c.Ok(
+		struct {
+			AccessToken string `json:"accessToken"`
+			MainToken   string `json:"mainToken"`
+		}{
+			AccessToken: accessToken,
+			MainToken:   auth.MainToken,
+		})
 }
@@ -0,0 +1,333 @@
+// The OAuth 2.0 authorization code grant, see: https://tools.ietf.org/html/rfc6749
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"whoam.xyz/ent"
+)
+
+// oauthError is an error response of RFC 6749 §4.1.2.1 and §5.2
+type oauthError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func invalidRequest(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "invalid_request", desc}
+}
+
+func invalidClient(desc string) *oauthError {
+	return &oauthError{http.StatusUnauthorized, "invalid_client", desc}
+}
+
+func invalidGrant(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "invalid_grant", desc}
+}
+
+func unsupportedGrantType(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "unsupported_grant_type", desc}
+}
+
+func unsupportedResponseType(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "unsupported_response_type", desc}
+}
+
+func unauthorizedClient(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "unauthorized_client", desc}
+}
+
+func invalidScope(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "invalid_scope", desc}
+}
+
+func loginRequired(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "login_required", desc}
+}
+
+func consentRequired(desc string) *oauthError {
+	return &oauthError{http.StatusBadRequest, "consent_required", desc}
+}
+
+func invalidToken(desc string) *oauthError {
+	return &oauthError{http.StatusUnauthorized, "invalid_token", desc}
+}
+
+func serverError(err error) *oauthError {
+	return &oauthError{http.StatusInternalServerError, "server_error", err.Error()}
+}
+
+// clientCredentials returns the client credentials of the request,
+// with client_secret_basic or client_secret_post, see RFC 6749 §2.3.1
+func clientCredentials(c *Context) (id string, secret string, basic bool, e *oauthError) {
+	id, secret, basic = c.Request.BasicAuth()
+	if basic {
+		if "" != c.PostForm("client_secret") {
+			return "", "", basic, invalidRequest("Only one client authentication method can be used")
+		}
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return "", "", basic, invalidClient("Malformed client credentials")
+		}
+		return id, secret, basic, nil
+	}
+
+	return c.PostForm("client_id"), c.PostForm("client_secret"), false, nil
+}
+
+// authenticateClient authenticates the client of the token request.
+// A confidential client must authenticate with its client secret,
+// a public client only needs to identify itself with client_id.
+func authenticateClient(c *Context) (*ent.Service, *oauthError) {
+	id, secret, basic, e := clientCredentials(c)
+	if e != nil {
+		return nil, e
+	}
+
+	if "" == id {
+		return nil, invalidRequest("Missing client_id or client credentials")
+	}
+
+	if basic {
+		c.Header("WWW-Authenticate", `Basic realm="whoam"`)
+	}
+
+	_service, err := client.Service.Get(ctx, id)
+	if err != nil {
+		return nil, invalidClient("Unknown client")
+	}
+
+	if isConfidential(_service) {
+		if "" == secret || !verifyClientSecret(_service, secret) {
+			return nil, invalidClient("Client authentication failed")
+		}
+	} else if "" != secret {
+		return nil, invalidClient("Public client has no client secret")
+	}
+
+	return _service, nil
+}
+
+// tokenResponse is a successful response of RFC 6749 §5.1
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func newTokenResponse(accessToken string, auth *ent.Oauth) *tokenResponse {
+	return &tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(timeoutAccessToken.Seconds()),
+		RefreshToken: auth.MainToken,
+		Scope:        auth.Scope,
+	}
+}
+
+// authorizeRequest is the authorization request of RFC 6749 §4.1.1 and RFC 7636 §4.3,
+// the RedirectURI must be matched with the registered redirect URIs of the client before redirecting.
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Scope               string `form:"scope"`
+	Nonce               string `form:"nonce"`
+	Prompt              string `form:"prompt" note:"Space-delimited, 'none' or 'consent' is supported, see OIDC Core §3.1.2.1"`
+}
+
+// pkceValue code_verifier and code_challenge use the same characters and length, see RFC 7636 §4.1
+var pkceValue = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// checkCodeChallenge validates the code challenge of the authorization request to the service,
+// and returns the code challenge method, which defaults to "plain", see RFC 7636 §4.3
+func checkCodeChallenge(_service *ent.Service, challenge, method string) (string, *oauthError) {
+	if "" == challenge {
+		if _service.RequirePkce {
+			return "", invalidRequest("Code challenge required")
+		}
+		if "" != method {
+			return "", invalidRequest("Missing 'code_challenge' parameter")
+		}
+		return "", nil
+	}
+
+	if !pkceValue.MatchString(challenge) {
+		return "", invalidRequest("Invalid code challenge")
+	}
+
+	switch method {
+	case "":
+		return "plain", nil
+	case "plain", "S256":
+		return method, nil
+	default:
+		return "", invalidRequest("Transform algorithm not supported")
+	}
+}
+
+// verifyCodeVerifier verifies the code_verifier of the token request
+// with the code challenge of the authorization request, see RFC 7636 §4.6
+func verifyCodeVerifier(oauthUser *userOAuth, verifier string) *oauthError {
+	if "" == oauthUser.CodeChallenge {
+		if "" != verifier {
+			return invalidGrant("The authorization request has no code challenge")
+		}
+		return nil
+	}
+
+	if !pkceValue.MatchString(verifier) {
+		return invalidGrant("Invalid code_verifier")
+	}
+
+	challenge := verifier
+	if "S256" == oauthUser.CodeChallengeMethod {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	if 1 != subtle.ConstantTimeCompare([]byte(challenge), []byte(oauthUser.CodeChallenge)) {
+		return invalidGrant("The code_verifier doesn't match the code challenge")
+	}
+
+	return nil
+}
+
+// redirectURL returns the redirect_uri with the given query parameters and the state
+func (r *authorizeRequest) redirectURL(values url.Values) string {
+	u, _ := url.Parse(r.RedirectURI)
+	query := u.Query()
+	for k, v := range values {
+		query[k] = v
+	}
+	if "" != r.State {
+		query.Set("state", r.State)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redirectError redirects the user-agent back to the client with the error, see RFC 6749 §4.1.2.1
+func (r *authorizeRequest) redirectError(c *Context, e *oauthError) error {
+	values := url.Values{"error": {e.Code}}
+	if "" != e.Description {
+		values.Set("error_description", e.Description)
+	}
+	return c.Found(r.redirectURL(values))
+}
+
+// PostOAuthToken is the token endpoint of RFC 6749 §3.2
+func PostOAuthToken(c *Context) error {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		return exchangeAuthorizationCode(c)
+	case "refresh_token":
+		return exchangeRefreshToken(c)
+	case "":
+		return c.OAuthError(invalidRequest("The form is missing the 'grant_type' parameter"))
+	default:
+		return c.OAuthError(unsupportedGrantType("Unsupported grant type: " + grantType))
+	}
+}
+
+// exchangeAuthorizationCode see RFC 6749 §4.1.3
+func exchangeAuthorizationCode(c *Context) error {
+	code, err := c.GetFormString("code")
+	if err != nil {
+		return c.OAuthError(invalidRequest(err.Error()))
+	}
+
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	// The request is validated before the code is redeemed, an invalid request doesn't use up the code
+	peek, err := peekOAuthCode(code)
+	if err != nil {
+		return c.OAuthError(invalidGrant(err.Error()))
+	}
+
+	if peek.ClientID != _service.ID {
+		return c.OAuthError(invalidGrant("The code was issued to another client"))
+	}
+
+	if peek.RedirectURI != c.PostForm("redirect_uri") {
+		return c.OAuthError(invalidGrant("The redirect_uri doesn't match the authorization request"))
+	}
+
+	if oe := verifyCodeVerifier(peek, c.PostForm("code_verifier")); oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	oauthUser, err := redeemOAuthCode(code)
+	if err != nil {
+		return c.OAuthError(invalidGrant(err.Error()))
+	}
+
+	accessToken, auth, err := newOAuthTokenInFamily(oauthUser.UserID, oauthUser.ClientID, oauthUser.Scope, oauthUser.Family)
+	if err != nil {
+		return c.OAuthError(serverError(err))
+	}
+
+	response := newTokenResponse(accessToken, auth)
+
+	if hasScope(oauthUser.Scope, "openid") {
+		_user, err := client.User.Get(ctx, oauthUser.UserID)
+		if err != nil {
+			return c.OAuthError(serverError(err))
+		}
+
+		response.IDToken, err = NewIDToken(_user, _service, oauthUser.Scope, oauthUser.Nonce, oauthUser.AuthTime, jwtKeys.SigningKey())
+		if err != nil {
+			return c.OAuthError(serverError(err))
+		}
+	}
+
+	return c.Ok(response)
+}
+
+// exchangeRefreshToken see RFC 6749 §6
+func exchangeRefreshToken(c *Context) error {
+	refreshToken, err := c.GetFormString("refresh_token")
+	if err != nil {
+		return c.OAuthError(invalidRequest(err.Error()))
+	}
+
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	accessToken, auth, err := refreshOAuthToken(refreshToken, _service.ID)
+	if err == errInvalidRefreshToken {
+		return c.OAuthError(invalidGrant(err.Error()))
+	}
+	if err != nil {
+		return c.OAuthError(serverError(err))
+	}
+
+	return c.Ok(newTokenResponse(accessToken, auth))
+}
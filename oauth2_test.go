@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent"
+)
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	// See RFC 7636 Appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	oauthUser := &userOAuth{
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: "S256",
+	}
+
+	if oe := verifyCodeVerifier(oauthUser, verifier); oe != nil {
+		t.Error(oe)
+	}
+	if oe := verifyCodeVerifier(oauthUser, verifier[1:]+"a"); oe == nil {
+		t.Error("mismatched code_verifier should be rejected")
+	}
+	if oe := verifyCodeVerifier(oauthUser, ""); oe == nil {
+		t.Error("missing code_verifier should be rejected")
+	}
+
+	oauthUser = &userOAuth{CodeChallenge: verifier, CodeChallengeMethod: "plain"}
+	if oe := verifyCodeVerifier(oauthUser, verifier); oe != nil {
+		t.Error(oe)
+	}
+
+	if oe := verifyCodeVerifier(&userOAuth{}, verifier); oe == nil {
+		t.Error("code_verifier without code challenge should be rejected")
+	}
+}
+
+func TestCheckCodeChallenge(t *testing.T) {
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if method, oe := checkCodeChallenge(&ent.Service{}, challenge, ""); oe != nil || method != "plain" {
+		t.Error("code challenge method should default to plain", method, oe)
+	}
+	if _, oe := checkCodeChallenge(&ent.Service{}, challenge, "S512"); oe == nil {
+		t.Error("unsupported code challenge method should be rejected")
+	}
+	if _, oe := checkCodeChallenge(&ent.Service{RequirePkce: true}, "", ""); oe == nil {
+		t.Error("code challenge should be required")
+	}
+	if _, oe := checkCodeChallenge(&ent.Service{}, "", ""); oe != nil {
+		t.Error(oe)
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	s := &ent.Service{Scopes: []string{"files.read"}}
+
+	scopes, oe := checkScope(s, "openid  files.read email openid")
+	if oe != nil || "email files.read openid" != strings.Join(scopes, " ") {
+		t.Error("scopes should be sorted and without duplicates", scopes, oe)
+	}
+	if _, oe := checkScope(s, "openid files.write"); oe == nil {
+		t.Error("unknown scope should be rejected")
+	}
+	if validScope("openid") || validScope(`files"read`) || !validScope("files.read") {
+		t.Error("custom scope validation is wrong")
+	}
+}
+
+// postToken requests the token endpoint with the form, and returns the status code and the JSON response
+func postToken(form url.Values) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	PostOAuthToken(&Context{c})
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestPostOAuthTokenAuthorizationCode(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("token@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_service := createSubjectService(t, "token.example.com", "")
+	createSubjectService(t, "other.token.example.com", "")
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	code, err := issueOAuthCode(&userOAuth{
+		UserID:              _user.ID,
+		ClientID:            _service.ID,
+		RedirectURI:         "https://token.example.com/callback",
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: "S256",
+		Scope:               "openid",
+		Nonce:               "nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := func(override ...string) url.Values {
+		values := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"client_id":     {_service.ID},
+			"redirect_uri":  {"https://token.example.com/callback"},
+			"code_verifier": {verifier},
+		}
+		for i := 0; i < len(override); i += 2 {
+			values.Set(override[i], override[i+1])
+		}
+		return values
+	}
+
+	// The invalid requests don't use up the code
+	invalids := map[string]url.Values{
+		"another client":       form("client_id", "other.token.example.com"),
+		"another redirect_uri": form("redirect_uri", "https://token.example.com/other"),
+		"a wrong verifier":     form("code_verifier", verifier[1:]+"a"),
+	}
+	for name, values := range invalids {
+		if code, response := postToken(values); http.StatusBadRequest != code || "invalid_grant" != response["error"] {
+			t.Error("the request of "+name+" should be an invalid grant", code, response)
+		}
+	}
+
+	status, response := postToken(form())
+	if http.StatusOK != status {
+		t.Fatal("the code should be exchanged", status, response)
+	}
+	accessToken, _ := response["access_token"].(string)
+	if "Bearer" != response["token_type"] || "" == response["refresh_token"] || "" == response["id_token"] || "openid" != response["scope"] {
+		t.Error("the response should have the tokens of the scope", response)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err != nil {
+		t.Error("the access token should be valid", err)
+	}
+
+	// The code is single-use, presenting it again revokes the tokens issued from it
+	if status, response = postToken(form()); http.StatusBadRequest != status || "invalid_grant" != response["error"] {
+		t.Error("the redeemed code should be an invalid grant", status, response)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err == nil {
+		t.Error("the access token issued from the reused code should be revoked")
+	}
+}
+
+func TestPostOAuthTokenRefreshToken(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("token.refresh@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_service := createSubjectService(t, "refresh.token.example.com", "")
+
+	_, auth, err := newOAuthToken(_user.ID, _service.ID, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {auth.MainToken}, "client_id": {_service.ID}}
+	status, response := postToken(values)
+	if http.StatusOK != status || "" == response["access_token"] || auth.MainToken == response["refresh_token"] {
+		t.Fatal("the refresh token should be rotated", status, response)
+	}
+
+	if status, response = postToken(url.Values{"grant_type": {"password"}, "client_id": {_service.ID}}); "unsupported_grant_type" != response["error"] {
+		t.Error("the password grant isn't supported", status, response)
+	}
+	if status, response = postToken(url.Values{"client_id": {_service.ID}}); "invalid_request" != response["error"] {
+		t.Error("the grant type is required", status, response)
+	}
+}
+
+func TestAuthorizeEndpointState(t *testing.T) {
+	setupOAuth(t)
+
+	_service, err := createSubjectService(t, "state.authorize.example.com", "").Update().
+		SetRedirectUris([]string{"https://state.authorize.example.com/callback"}).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_session, cookie := loginSession(t, "state.authorize@example.com")
+	userID, err := _session.QueryUser().OnlyID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveGrant(userID, _service.ID, []string{"openid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// authorize requests the authorization endpoint, and returns the query of the redirection
+	authorize := func(query url.Values, cookies ...*http.Cookie) url.Values {
+		c, w := newSessionContext("GET", cookies...)
+		c.Request.URL.RawQuery = query.Encode()
+		authorizeEndpoint(c)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if http.StatusFound != w.Code || err != nil {
+			t.Fatal("the user-agent should be redirected to the client", w.Code, w.Body.String())
+		}
+		return location.Query()
+	}
+
+	query := url.Values{"response_type": {"code"}, "client_id": {_service.ID}, "scope": {"openid"}}
+
+	// The state is optional, see RFC 6749 §4.1.1, and is only echoed if it's present
+	redirected := authorize(query, cookie)
+	if "" == redirected.Get("code") || redirected["state"] != nil {
+		t.Error("the code should be issued without the state", redirected)
+	}
+	query.Set("state", "xyz")
+	if redirected = authorize(query, cookie); "" == redirected.Get("code") || "xyz" != redirected.Get("state") {
+		t.Error("the code should be issued with the state", redirected)
+	}
+
+	query.Set("prompt", "none")
+	if redirected = authorize(query); "login_required" != redirected.Get("error") || "xyz" != redirected.Get("state") {
+		t.Error("the error should be redirected with the state", redirected)
+	}
+	query.Del("state")
+	if redirected = authorize(query); "login_required" != redirected.Get("error") || redirected["state"] != nil {
+		t.Error("the error should be redirected without the state", redirected)
+	}
+}
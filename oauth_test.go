@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+// setupOAuth initializes the globals used by OAuth business with an in-memory database
+func setupOAuth(t *testing.T) {
+	ctx, client = CreateClient(t)
+	if client == nil {
+		t.Fatal("failed to create ent client")
+	}
+
+	key, err := NewJWTKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys = NewKeySet(key)
+
+	InitStore()
+	InitUser()
+	InitService()
+	InitSubject()
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("rotation@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, first, err := newOAuthToken(_user.ID, MainServiceID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, second, err := refreshOAuthToken(first.MainToken, MainServiceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.MainToken == first.MainToken || second.Family != first.Family {
+		t.Error("refresh token should be rotated in the same family")
+	}
+
+	accessToken, third, err := refreshOAuthToken(second.MainToken, MainServiceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated refresh token of another client isn't a reuse of the family
+	if _, _, err = refreshOAuthToken(first.MainToken, "other.example.com"); err != errInvalidRefreshToken {
+		t.Error("refresh token of another client should be rejected", err)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err != nil {
+		t.Error("the family shouldn't be revoked by another client", err)
+	}
+
+	// Replay the rotated refresh token, the whole family is revoked
+	if _, _, err = refreshOAuthToken(first.MainToken, MainServiceID); err != errInvalidRefreshToken {
+		t.Error("rotated refresh token should be rejected", err)
+	}
+	if _, _, err = refreshOAuthToken(third.MainToken, MainServiceID); err != errInvalidRefreshToken {
+		t.Error("refresh token of the revoked family should be rejected", err)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err == nil {
+		t.Error("access token of the revoked family should be rejected")
+	}
+}
+
+func TestRefreshTokenMaxSessionLifetime(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("lifetime@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_service, err := client.Service.Create().
+		SetID("lifetime.example.com").
+		SetName("lifetime").
+		SetSubject("").
+		SetDomain("https://lifetime.example.com").
+		SetCloneURI("https://github.com/excing/whoam.git").
+		SetMaxSessionLifetime(60).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, auth, err := newOAuthToken(_user.ID, _service.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rotated, err := refreshOAuthToken(auth.MainToken, _service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ExpiredAt.After(authorizedAtOf(auth).Add(60 * 1e9)) {
+		t.Error("refresh token shouldn't expire beyond the max session lifetime", rotated.ExpiredAt)
+	}
+}
+
+func TestRedeemOAuthCodeConcurrently(t *testing.T) {
+	setupOAuth(t)
+
+	code, err := issueOAuthCode(&userOAuth{UserID: 1, ClientID: MainServiceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := redeemOAuthCode(code); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if 1 != redeemed {
+		t.Error("the code should be redeemed exactly once", redeemed)
+	}
+}
+
+func TestRedeemOAuthCodeReuse(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("reuse@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := issueOAuthCode(&userOAuth{UserID: _user.ID, ClientID: MainServiceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oauthUser, err := redeemOAuthCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken, auth, err := newOAuthTokenInFamily(oauthUser.UserID, oauthUser.ClientID, oauthUser.Scope, oauthUser.Family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The code is presented again, the tokens issued from it are revoked
+	if _, err = redeemOAuthCode(code); err != errInvalidOAuthCode {
+		t.Error("the code shouldn't be redeemed again", err)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err == nil {
+		t.Error("access token issued from the reused code should be revoked")
+	}
+	if _, _, err = refreshOAuthToken(auth.MainToken, MainServiceID); err != errInvalidRefreshToken {
+		t.Error("refresh token issued from the reused code should be revoked", err)
+	}
+}
+
+func TestGetUserLegacy(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("legacy@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// getUser requests the basic information of the user with a token of the scope
+	getUser := func(scope string) map[string]interface{} {
+		accessToken, _, err := newOAuthToken(_user.ID, MainServiceID, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, w := newSessionContext("GET")
+		c.Request.Header.Set("Authorization", "Bearer "+accessToken)
+		GetUser(c)
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response
+	}
+
+	if response := getUser(""); "legacy@example.com" != response["email"] || float64(_user.ID) != response["id"] {
+		t.Error("the legacy token should get the email", response)
+	}
+	if response := getUser("openid"); nil != response["email"] {
+		t.Error("the email should be granted by the email scope", response)
+	}
+	if response := getUser("openid email"); "legacy@example.com" != response["email"] {
+		t.Error("the email scope should get the email", response)
+	}
+}
@@ -0,0 +1,154 @@
+// OpenID Connect provider, see: https://openid.net/specs/openid-connect-core-1_0.html
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent"
+)
+
+const timeoutIDToken = time.Hour // id_token timeout: 1h
+const typeIDToken = "JWT"        // the `typ` header of id_tokens, they aren't access tokens
+
+// IDTokenClaims is the claims of the OpenID Connect ID Token, see OIDC Core §2
+type IDTokenClaims struct {
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	ProfileClaims
+	jwt.StandardClaims
+}
+
+// ProfileClaims is the claims of the user granted by the scopes, see OIDC Core §5.4.
+// The `email` scope grants the primary email, the `profile` scope grants the profile.
+type ProfileClaims struct {
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+	Zoneinfo      string `json:"zoneinfo,omitempty"`
+	UpdatedAt     int64  `json:"updated_at,omitempty"`
+}
+
+// profileClaimsOf returns the claims of the user granted by the space-delimited scope
+func profileClaimsOf(_user *ent.User, scope string) ProfileClaims {
+	var claims ProfileClaims
+	if hasScope(scope, "email") {
+		// The primary email is always verified
+		claims.Email = _user.Email
+		claims.EmailVerified = true
+	}
+	if hasScope(scope, "profile") {
+		claims.Name = _user.Name
+		claims.Picture = _user.AvatarURL
+		claims.Locale = _user.Locale
+		claims.Zoneinfo = _user.Timezone
+		claims.UpdatedAt = _user.UpdatedAt.Unix()
+	}
+	return claims
+}
+
+// issuer returns the issuer identifier of whoam
+func issuer() string {
+	if "" != config.Issuer {
+		return strings.TrimSuffix(config.Issuer, "/")
+	}
+	return "http://localhost:" + strconv.Itoa(config.Port)
+}
+
+// hasScope reports whether the space-delimited scope contains the s, see RFC 6749 §3.3
+func hasScope(scope string, s string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewIDToken creates a new id_token of the user for the service with the claims granted by the scope, signed by the key
+func NewIDToken(_user *ent.User, _service *ent.Service, scope string, nonce string, authTime int64, key *JWTKey) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(key.Method, &IDTokenClaims{
+		AuthTime:      authTime,
+		Nonce:         nonce,
+		ProfileClaims: profileClaimsOf(_user, scope),
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer(),
+			Subject:   subjectOf(_user.ID, _service),
+			Audience:  _service.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(timeoutIDToken).Unix(),
+		},
+	})
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typeIDToken
+
+	return token.SignedString(key.PrivateKey)
+}
+
+// accessTokenOf returns the access token of the Authorization header,
+// the "Bearer" scheme of RFC 6750 §2.1 is optional.
+func accessTokenOf(c *Context) string {
+	accessToken := c.GetHeader("Authorization")
+	if len(accessToken) > 7 && strings.EqualFold(accessToken[:7], "Bearer ") {
+		return accessToken[7:]
+	}
+	return accessToken
+}
+
+// GetOpenIDConfiguration returns the OpenID Provider Metadata, see OIDC Discovery §3
+func GetOpenIDConfiguration(c *Context) error {
+	iss := issuer()
+
+	return c.Ok(gin.H{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/oauth/authorize",
+		"token_endpoint":                        iss + "/oauth/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/.well-known/jwks.json",
+		"revocation_endpoint":                   iss + "/oauth/revoke",
+		"introspection_endpoint":                iss + "/oauth/introspect",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public", "pairwise"},
+		"id_token_signing_alg_values_supported": []string{config.SigningAlg},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name", "picture", "locale", "zoneinfo", "updated_at"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+	})
+}
+
+// GetUserInfo returns the claims of the authenticated user granted by the scope of the access token, see OIDC Core §5.3
+func GetUserInfo(c *Context) error {
+	_claims, err := FilterJWTToken(accessTokenOf(c), jwtKeys)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return c.OAuthError(invalidToken(err.Error()))
+	}
+
+	_user, err := userOfClaims(_claims)
+	if err == errNoTokenUser {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return c.OAuthError(invalidToken(err.Error()))
+	}
+	if err != nil {
+		return c.OAuthError(serverError(err))
+	}
+
+	return c.Ok(
+		struct {
+			Subject string `json:"sub"`
+			ProfileClaims
+		}{
+			Subject:       _claims.Subject,
+			ProfileClaims: profileClaimsOf(_user, _claims.Scope),
+		})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent/service"
+)
+
+func TestIDTokenClaims(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("idtoken@example.com").SetName("ID Token").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_service := createSubjectService(t, "idtoken.example.com", service.SubjectTypePairwise)
+
+	// exchange exchanges the code of the authorization at the token endpoint
+	exchange := func(oauthUser userOAuth) (int, map[string]interface{}) {
+		code := New32bitID()
+		if err := oauthCodeBox.SetVal(code, oauthUser); err != nil {
+			t.Fatal(err)
+		}
+
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {_service.ID}, "redirect_uri": {oauthUser.RedirectURI}}
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		PostOAuthToken(&Context{c})
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	authTime := time.Now().Add(-time.Minute).Unix()
+	status, response := exchange(userOAuth{
+		UserID:      _user.ID,
+		ClientID:    _service.ID,
+		RedirectURI: "https://idtoken.example.com/callback",
+		Scope:       "openid email",
+		Nonce:       "n-0S6_WzA2Mj",
+		AuthTime:    authTime,
+	})
+	if http.StatusOK != status {
+		t.Fatal("the code should be exchanged", status, response)
+	}
+
+	idToken, _ := response["id_token"].(string)
+	claims := &IDTokenClaims{}
+	if err = parseJWT(idToken, jwtKeys, typeIDToken, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if issuer() != claims.Issuer || _service.ID != claims.Audience {
+		t.Error("the id_token should be issued by whoam to the service", claims.Issuer, claims.Audience)
+	}
+	if "n-0S6_WzA2Mj" != claims.Nonce || authTime != claims.AuthTime {
+		t.Error("the id_token should have the nonce and auth_time of the authorization", claims.Nonce, claims.AuthTime)
+	}
+	if subjectOf(_user.ID, _service) != claims.Subject || strconv.Itoa(_user.ID) == claims.Subject {
+		t.Error("the id_token should have the pairwise subject", claims.Subject)
+	}
+	if "idtoken@example.com" != claims.Email || !claims.EmailVerified || "" != claims.Name {
+		t.Error("the id_token should have the claims of the email scope only", claims.ProfileClaims)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64(timeoutIDToken.Seconds()) {
+		t.Error("the id_token should expire in timeoutIDToken", claims.IssuedAt, claims.ExpiresAt)
+	}
+
+	// The token without the openid scope has no id_token
+	status, response = exchange(userOAuth{UserID: _user.ID, ClientID: _service.ID, Scope: "email"})
+	if http.StatusOK != status || nil != response["id_token"] {
+		t.Error("the id_token should be issued only for the openid scope", status, response)
+	}
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+	defer func(iss string) { config.Issuer = iss }(config.Issuer)
+	config.Issuer = "https://whoam.example.com/"
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	GetOpenIDConfiguration(&Context{c})
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// See OIDC Discovery §3, the issuer has no trailing slash
+	endpoints := map[string]string{
+		"issuer":                 "https://whoam.example.com",
+		"authorization_endpoint": "https://whoam.example.com/oauth/authorize",
+		"token_endpoint":         "https://whoam.example.com/oauth/token",
+		"userinfo_endpoint":      "https://whoam.example.com/userinfo",
+		"jwks_uri":               "https://whoam.example.com/.well-known/jwks.json",
+	}
+	for name, want := range endpoints {
+		if want != metadata[name] {
+			t.Errorf("%v = %v, want %v", name, metadata[name], want)
+		}
+	}
+
+	for _, name := range []string{"response_types_supported", "subject_types_supported", "id_token_signing_alg_values_supported", "scopes_supported"} {
+		if values, ok := metadata[name].([]interface{}); !ok || 0 == len(values) {
+			t.Error("the metadata should have "+name, metadata[name])
+		}
+	}
+}
+
+func TestGetUserInfo(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("userinfo@example.com").SetName("User Info").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_service := createSubjectService(t, "userinfo.example.com", service.SubjectTypePairwise)
+
+	// getUserInfo requests the userinfo endpoint with the access token
+	getUserInfo := func(accessToken string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/userinfo", nil)
+		c.Request.Header.Set("Authorization", "Bearer "+accessToken)
+		GetUserInfo(&Context{c})
+
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	accessToken, _, err := newOAuthToken(_user.ID, _service.ID, "openid profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response := getUserInfo(accessToken)
+	if http.StatusOK != status || subjectOf(_user.ID, _service) != response["sub"] {
+		t.Fatal("the userinfo should have the pairwise subject", status, response)
+	}
+	if "User Info" != response["name"] || nil != response["email"] || nil != response["id"] {
+		t.Error("the userinfo should have the claims of the profile scope only", response)
+	}
+
+	expired, err := NewJWTToken(_user.ID, _service, "", "openid email", -time.Minute, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := NewIDToken(_user, _service, "openid", "", 0, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]string{"no token": "", "an expired token": expired, "an id_token": idToken, "a malformed token": "not.a.token"}
+	for name, token := range tokens {
+		if status, response = getUserInfo(token); http.StatusUnauthorized != status || "invalid_token" != response["error"] {
+			t.Error("the request with "+name+" should be unauthorized", status, response)
+		}
+	}
+
+	// The token of a deleted user has no user
+	other, err := client.User.Create().SetEmail("userinfo.deleted@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err = NewJWTToken(other.ID, exampleService, "", "openid", time.Minute, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.User.DeleteOne(other).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status, response = getUserInfo(accessToken); http.StatusUnauthorized != status || "invalid_token" != response["error"] {
+		t.Error("the token without a user should be unauthorized", status, response)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/mail"
+)
+
+const intervalOutboxPoll = 5 * time.Second // poll the outbox for due mails: 5s
+const timeoutMailLease = 5 * time.Minute   // a sending mail is sent again if its worker hasn't finished: 5min
+const backoffMailBase = 30 * time.Second   // delay before the first retry: 30s
+const backoffMailMax = time.Hour           // maximum delay between retries: 1h
+
+// outboxSignal wakes up a worker when a mail is queued
+var outboxSignal = make(chan struct{}, 1)
+
+// InitOutbox starts config.MailWorkers workers to send the mails of the outbox
+func InitOutbox() {
+	for i := 0; i < config.MailWorkers; i++ {
+		go func() {
+			ticker := time.NewTicker(intervalOutboxPoll)
+			for {
+				select {
+				case <-outboxSignal:
+				case <-ticker.C:
+				}
+
+				// Send all due mails before waiting again
+				for {
+					sent, err := deliverNextMail()
+					if err != nil {
+						log.Println("failed to deliver mail:", err)
+					}
+					if !sent {
+						break
+					}
+				}
+			}
+		}()
+	}
+}
+
+// EnqueueMail queues the email in the outbox, it's sent by the background workers
+func EnqueueMail(to string, subject string, body string) error {
+	_, err := client.Mail.Create().
+		SetTo(to).
+		SetSubject(subject).
+		SetBody(body).
+		Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	wakeOutbox()
+	return nil
+}
+
+// wakeOutbox wakes up a worker to send the due mails
+func wakeOutbox() {
+	select {
+	case outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// mailBackoff returns the delay before the next attempt after the attempts failed,
+// it doubles after every failure.
+func mailBackoff(attempts int) time.Duration {
+	backoff := backoffMailBase
+	for i := 1; i < attempts && backoff < backoffMailMax; i++ {
+		backoff *= 2
+	}
+	if backoff > backoffMailMax {
+		backoff = backoffMailMax
+	}
+	return backoff
+}
+
+// claimNextMail leases the next due mail to the caller, it returns nil if there is no due mail.
+// A sending mail whose lease has expired is due again, its worker may have crashed.
+func claimNextMail() (*ent.Mail, error) {
+	for {
+		now := time.Now()
+		_mail, err := client.Mail.Query().
+			Where(mail.StatusIn(mail.StatusPending, mail.StatusSending)).
+			Where(mail.NextAttemptAtLTE(now)).
+			Order(ent.Asc(mail.FieldNextAttemptAt)).
+			First(ctx)
+		if ent.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Only one worker updates the mail, the others try the next one
+		n, err := client.Mail.Update().
+			Where(mail.IDEQ(_mail.ID)).
+			Where(mail.StatusEQ(_mail.Status)).
+			Where(mail.NextAttemptAtLTE(now)).
+			SetStatus(mail.StatusSending).
+			SetNextAttemptAt(now.Add(timeoutMailLease)).
+			Save(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if 1 == n {
+			return _mail, nil
+		}
+	}
+}
+
+// deliverNextMail sends the next due mail, and reports whether a mail was due.
+// A failed mail is retried with exponential backoff,
+// and is dead after config.MailMaxAttempts attempts.
+func deliverNextMail() (bool, error) {
+	_mail, err := claimNextMail()
+	if err != nil || _mail == nil {
+		return false, err
+	}
+
+	attempts := _mail.Attempts + 1
+	err = mailer.Send(_mail.To, _mail.Subject, _mail.Body)
+	if err == nil {
+		_, err = _mail.Update().
+			SetStatus(mail.StatusSent).
+			SetAttempts(attempts).
+			SetSentAt(time.Now()).
+			Save(ctx)
+		return true, err
+	}
+
+	update := _mail.Update().SetAttempts(attempts).SetLastError(err.Error())
+	if attempts >= config.MailMaxAttempts {
+		update.SetStatus(mail.StatusDead)
+	} else {
+		update.SetStatus(mail.StatusPending).SetNextAttemptAt(time.Now().Add(mailBackoff(attempts)))
+	}
+	_, err = update.Save(ctx)
+	return true, err
+}
+
+// GetAdminMails lists the mails of the status, dead by default, newest first
+func GetAdminMails(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+	if !isAdmin(_user) {
+		return c.Forbidden("Only administrators can manage mails")
+	}
+
+	status := mail.Status(c.DefaultQuery("status", string(mail.StatusDead)))
+	if err := mail.StatusValidator(status); err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	offset, limit := c.Page()
+
+	mails, err := client.Mail.Query().
+		Where(mail.StatusEQ(status)).
+		Order(ent.Desc(mail.FieldCreatedAt)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(mails)
+}
+
+// PostAdminMailResend queues the mail to be sent again, the attempts are reset
+func PostAdminMailResend(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+	if !isAdmin(_user) {
+		return c.Forbidden("Only administrators can manage mails")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.BadRequest("Invalid mail id")
+	}
+
+	n, err := client.Mail.Update().
+		Where(mail.IDEQ(id)).
+		Where(mail.StatusIn(mail.StatusDead, mail.StatusSent)).
+		SetStatus(mail.StatusPending).
+		SetAttempts(0).
+		SetNextAttemptAt(time.Now()).
+		Save(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+	if 0 == n {
+		return c.NotFound("Mail not found, or it's still being sent")
+	}
+
+	wakeOutbox()
+
+	return c.NoContent()
+}
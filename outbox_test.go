@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"whoam.xyz/ent/mail"
+)
+
+// fakeMailer fails the first failures sends, and records the sent mails
+type fakeMailer struct {
+	sync.Mutex
+	failures int
+	sent     []string
+}
+
+func (m *fakeMailer) Send(to string, subject string, body string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if 0 < m.failures {
+		m.failures--
+		return errors.New("relay is unavailable")
+	}
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func setupOutbox(t *testing.T, m Mailer) {
+	setupOAuth(t)
+	mailer = m
+
+	if _, err := client.Mail.Delete().Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMailBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	}
+
+	for attempts, want := range tests {
+		if got := mailBackoff(attempts); got != want {
+			t.Errorf("mailBackoff(%v) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestDeliverMailRetry(t *testing.T) {
+	m := &fakeMailer{failures: 2}
+	setupOutbox(t, m)
+
+	if err := EnqueueMail("aoli@example.com", "Login WHOAM", "<p>AB12</p>"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if sent, err := deliverNextMail(); !sent || err != nil {
+			t.Fatal("the queued mail should be due", sent, err)
+		}
+
+		_mail := client.Mail.Query().OnlyX(ctx)
+		if mail.StatusPending != _mail.Status || i != _mail.Attempts || "" == _mail.LastError {
+			t.Fatal("the failed mail should be retried", _mail)
+		}
+		if _mail.NextAttemptAt.Before(time.Now().Add(mailBackoff(i) - time.Second)) {
+			t.Error("the failed mail should be retried after the backoff", _mail.NextAttemptAt)
+		}
+
+		if sent, _ := deliverNextMail(); sent {
+			t.Fatal("the failed mail shouldn't be due before the backoff")
+		}
+
+		// The backoff elapses
+		client.Mail.Update().SetNextAttemptAt(time.Now()).ExecX(ctx)
+	}
+
+	if sent, err := deliverNextMail(); !sent || err != nil {
+		t.Fatal("the queued mail should be due", sent, err)
+	}
+
+	_mail := client.Mail.Query().OnlyX(ctx)
+	if mail.StatusSent != _mail.Status || 3 != _mail.Attempts || nil == _mail.SentAt {
+		t.Error("the mail should be sent at the third attempt", _mail)
+	}
+	if 1 != len(m.sent) {
+		t.Error("the mail should be sent once", m.sent)
+	}
+}
+
+func TestDeliverMailDead(t *testing.T) {
+	setupOutbox(t, &fakeMailer{failures: config.MailMaxAttempts})
+
+	if err := EnqueueMail("aoli@example.com", "Login WHOAM", "<p>AB12</p>"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < config.MailMaxAttempts; i++ {
+		client.Mail.Update().SetNextAttemptAt(time.Now()).ExecX(ctx)
+		if sent, err := deliverNextMail(); !sent || err != nil {
+			t.Fatal("the queued mail should be due", sent, err)
+		}
+	}
+
+	_mail := client.Mail.Query().OnlyX(ctx)
+	if mail.StatusDead != _mail.Status || config.MailMaxAttempts != _mail.Attempts {
+		t.Error("the mail should be dead after the max attempts", _mail)
+	}
+
+	client.Mail.Update().SetNextAttemptAt(time.Now()).ExecX(ctx)
+	if sent, _ := deliverNextMail(); sent {
+		t.Error("the dead mail shouldn't be sent again")
+	}
+}
+
+func TestClaimNextMailConcurrently(t *testing.T) {
+	setupOutbox(t, &fakeMailer{})
+
+	if err := EnqueueMail("aoli@example.com", "Login WHOAM", "<p>AB12</p>"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _mail, err := claimNextMail(); err == nil && _mail != nil {
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if 1 != claimed {
+		t.Error("the mail should be claimed by exactly one worker", claimed)
+	}
+
+	// The lease expires, the worker may have crashed
+	client.Mail.Update().SetNextAttemptAt(time.Now().Add(-time.Second)).ExecX(ctx)
+	if _mail, err := claimNextMail(); err != nil || _mail == nil {
+		t.Error("the mail of the expired lease should be claimed again", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a sliding window rate limiter,
+// at most limit requests of a key are allowed within any window.
+// The requests are recorded in the memory of the process, so the limits are per whoam server,
+// with N servers behind a load balancer a key is allowed up to N times the limit.
+type RateLimiter struct {
+	sync.Mutex
+	limit    int
+	window   time.Duration
+	requests map[string][]time.Time
+	prunedAt time.Time
+
+	// now returns the current time, it's replaceable for testing
+	now func() time.Time
+}
+
+// NewRateLimiter returns a rate limiter of limit requests per window
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:    limit,
+		window:   window,
+		requests: make(map[string][]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Allow records a request of the key and reports whether it's allowed,
+// if not, it also returns the duration after which a request will be allowed.
+// A rejected request isn't recorded.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.prunedAt) > rl.window {
+		rl.prune(now)
+	}
+
+	requests := rl.inWindow(key, now)
+	if len(requests) >= rl.limit {
+		rl.requests[key] = requests
+		return false, requests[len(requests)-rl.limit].Add(rl.window).Sub(now)
+	}
+
+	rl.requests[key] = append(requests, now)
+	return true, 0
+}
+
+// inWindow returns the requests of the key within the window before now
+func (rl *RateLimiter) inWindow(key string, now time.Time) []time.Time {
+	requests := rl.requests[key]
+	i := 0
+	for i < len(requests) && !requests[i].After(now.Add(-rl.window)) {
+		i++
+	}
+	return requests[i:]
+}
+
+// prune deletes the keys without requests within the window
+func (rl *RateLimiter) prune(now time.Time) {
+	for key := range rl.requests {
+		if 0 == len(rl.inWindow(key, now)) {
+			delete(rl.requests, key)
+		}
+	}
+	rl.prunedAt = now
+}
+
+// Rate limiters of the email login, keyed by the action and the email or client IP
+var emailRateLimiter *RateLimiter
+var ipRateLimiter *RateLimiter
+
+// pollRateLimiter limits the status requests of the magic link login, keyed by the verification token
+var pollRateLimiter *RateLimiter
+
+// clientIP returns the IP of the client, which is the remote address of the connection.
+// The forwarded headers can be set by anyone, so they are used only if config.TrustProxy.
+func clientIP(c *Context) string {
+	if config.TrustProxy {
+		return c.ClientIP()
+	}
+
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	return ip
+}
+
+// allowRequest reports whether the action of the email from the client IP is allowed by the rate limits,
+// if not, the Retry-After header is set.
+func allowRequest(c *Context, action string, email string) bool {
+	ok, retry := ipRateLimiter.Allow(action + ":" + clientIP(c))
+	if ok {
+		ok, retry = emailRateLimiter.Allow(action + ":" + strings.ToLower(email))
+	}
+
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	}
+
+	return ok
+}
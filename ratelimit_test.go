@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(3, time.Minute)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatal("request within the limit should be allowed", i)
+		}
+		now = now.Add(10 * time.Second)
+	}
+
+	ok, retry := rl.Allow("a")
+	if ok {
+		t.Fatal("request over the limit should be rejected")
+	}
+	if retry != 30*time.Second {
+		t.Error("retry after should be when the first request leaves the window", retry)
+	}
+
+	if ok, _ := rl.Allow("b"); !ok {
+		t.Error("other keys shouldn't be limited")
+	}
+
+	// The window slides, only the first request has left
+	now = now.Add(30 * time.Second)
+	if ok, _ := rl.Allow("a"); !ok {
+		t.Error("request should be allowed after the window slides")
+	}
+	if ok, _ := rl.Allow("a"); ok {
+		t.Error("request over the limit should be rejected")
+	}
+
+	now = now.Add(2 * time.Minute)
+	rl.Allow("c")
+	if _, ok := rl.requests["b"]; ok {
+		t.Error("keys without requests in the window should be pruned")
+	}
+}
+
+func TestFailVerification(t *testing.T) {
+	InitStore()
+	InitUser()
+
+	token := New64BitID()
+	userVerificaBox.SetVal(token, userVerificationForm{Email: "a@example.com", State: "state", Code: "CODE", Token: token})
+
+	for i := 1; i < config.MaxCodeAttempts; i++ {
+		failVerification(token)
+	}
+
+	var form userVerificationForm
+	if err := userVerificaBox.Val(token, &form); err != nil {
+		t.Fatal("token should be valid before the max attempts", err)
+	}
+
+	failVerification(token)
+	if err := userVerificaBox.Val(token, &form); err == nil {
+		t.Error("token should be invalidated after the max attempts")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trustProxy bool) { config.TrustProxy = trustProxy }(config.TrustProxy)
+
+	c, _ := newSessionContext("POST")
+	c.Request.RemoteAddr = "203.0.113.7:52100"
+	c.Request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	c.Request.Header.Set("X-Real-IP", "198.51.100.2")
+
+	config.TrustProxy = false
+	if ip := clientIP(c); "203.0.113.7" != ip {
+		t.Error("the forwarded headers shouldn't be trusted without a proxy", ip)
+	}
+
+	config.TrustProxy = true
+	if ip := clientIP(c); "198.51.100.1" != ip {
+		t.Error("the forwarded headers of the trusted proxy should be used", ip)
+	}
+}
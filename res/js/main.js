@@ -12,14 +12,69 @@ function onLoginCode() {
     },
   })
     .then(function (response) {
-      loginToken = response.data
+      loginToken = response.data.token
       loginState = state
+      // The same code is shown on the page of the magic link
+      const match = document.getElementById('match')
+      if (null != match) {
+        document.getElementById('matchCode').innerText = response.data.matchCode
+        match.hidden = false
+      }
+      pollLoginStatus(email, state, response.data.token)
     })
     .catch(function (error) {
       alert(error.response.data);
     });
 }
 
+// pollLoginStatus waits for the login approved by the magic link of the email,
+// the server holds every request until the login is approved or the request times out.
+function pollLoginStatus(email, state, token) {
+  axios({
+    method: 'post',
+    url: '/api/v1/user/main/status',
+    data: {
+      email: email,
+      state: state,
+      token: token,
+    },
+  })
+    .then(function (response) {
+      if (token != loginToken) {
+        return
+      }
+      if (204 == response.status) {
+        pollLoginStatus(email, state, token)
+      } else {
+        loginSucceed(response, typeof onLoginSuccess === 'function' ? onLoginSuccess : undefined)
+      }
+    })
+}
+
+// csrfToken is the CSRF token of the browser session, the session itself is in an HttpOnly cookie
+var csrfToken
+
+// csrfTokenOf returns the CSRF token of the login, or the one of the page
+function csrfTokenOf() {
+  if (undefined == csrfToken) {
+    const meta = document.querySelector('meta[name="csrf-token"]')
+    if (null != meta) {
+      csrfToken = meta.content
+    }
+  }
+  return csrfToken
+}
+
+function loginSucceed(response, callback) {
+  csrfToken = response.data.csrfToken
+
+  if (undefined != callback) {
+    callback(response)
+  } else {
+    window.location.href = "/user/oauth" + window.location.search
+  }
+}
+
 function loginAuth(callback) {
   const email = document.getElementById('email').value
   const code = document.getElementById('code').value
@@ -35,15 +90,8 @@ function loginAuth(callback) {
     },
   })
     .then(function (response) {
-      var user = response.data
-      Cookies.set('access_token', user.accessToken)
-      localStorage.setItem("main_token", user.mainToken)
-
-      if (undefined != callback) {
-        callback(response)
-      } else {
-        window.location.href = "/user/oauth" + window.location.search
-      }
+      loginToken = undefined
+      loginSucceed(response, callback)
     })
 }
 
@@ -51,36 +99,92 @@ function onAllowAuth() {
   axios({
     method: 'post',
     url: '/api/v1/user/oauth/auth',
+    headers: {
+      'X-CSRF-Token': csrfTokenOf(),
+    },
     data: {
-      mainToken: localStorage.getItem('main_token'),
       clientId: clientId,
+      redirectUri: url.searchParams.get('redirect_uri'),
       state: state,
+      codeChallenge: url.searchParams.get('code_challenge'),
+      codeChallengeMethod: url.searchParams.get('code_challenge_method'),
+      scope: url.searchParams.get('scope'),
+      nonce: url.searchParams.get('nonce'),
     },
   })
     .then(function (response) {
       const code = response.data
-      window.location.href = redirect_uri + "?return_to=" + return_to + "&code=" + code
+      const target = new URL(redirect_uri)
+      if (null != return_to) {
+        target.searchParams.set('return_to', return_to)
+      }
+      target.searchParams.set('code', code)
+      if (null != state) {
+        target.searchParams.set('state', state)
+      }
+      window.location.href = target.href
     })
 }
 
-function refreshToken(successed, failured) {
+function onDenyAuth() {
+  const target = new URL(redirect_uri)
+  target.searchParams.set('error', 'access_denied')
+  if (null != state) {
+    target.searchParams.set('state', state)
+  }
+  window.location.href = target.href
+}
+
+function onApproveLogin(token) {
   axios({
     method: 'post',
-    url: '/api/v1/user/oauth/refresh',
+    url: '/api/v1/user/main/approve',
     data: {
-      mainToken: localStorage.getItem('main_token'),
+      token: token,
     },
   })
     .then(function (response) {
-      Cookies.set('access_token', response.data)
-
-      if (undefined != successed) {
-        successed(response)
-      }
+      document.getElementById('approve').classList.add('hide')
+      document.getElementById('approved').classList.remove('hide')
     })
-    .catch(function (response) {
-      if (undefined != failured) {
-        failured(response)
-      }
+    .catch(function (error) {
+      alert(error.response.data);
+    });
+}
+
+// accountRequest sends the state-changing request of the account page, and reloads the page
+function accountRequest(method, url) {
+  axios({
+    method: method,
+    url: url,
+    headers: {
+      'X-CSRF-Token': csrfTokenOf(),
+    },
+  })
+    .then(function (response) {
+      location.reload()
     })
-}
\ No newline at end of file
+    .catch(function (error) {
+      alert(error.response.data);
+    });
+}
+
+function onRevokeService(id) {
+  accountRequest('delete', '/api/v1/user/account/services/' + encodeURIComponent(id))
+}
+
+function onRevokeAuthorization(id) {
+  accountRequest('delete', '/api/v1/user/account/authorizations/' + id)
+}
+
+function onEndSession(id) {
+  accountRequest('delete', '/api/v1/user/account/sessions/' + id)
+}
+
+function onLogout() {
+  accountRequest('post', '/api/v1/user/main/logout')
+}
+
+function onLogoutAll() {
+  accountRequest('post', '/api/v1/user/main/logout/all')
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/oauth"
+	"whoam.xyz/ent/user"
+)
+
+var errNoTokenID = errors.New("Token has no jti")
+
+// revokedTokenBox is the denylist of revoked access tokens,
+// the key is `jti:<jti>` of an access token, or `sid:<sid>` of all access tokens issued from a refresh token family.
+// An entry expires after all of its access tokens have expired, it's kept in the database store so that it isn't evicted before.
+var revokedTokenBox *Box
+
+// isTokenRevoked reports whether the access token has been revoked
+func isTokenRevoked(claims *StandardClaims) bool {
+	if revokedTokenBox == nil {
+		return false
+	}
+
+	if "" != claims.Id {
+		if revoked, _ := revokedTokenBox.BoolVal("jti:" + claims.Id); revoked {
+			return true
+		}
+	}
+
+	if "" != claims.SessionID {
+		if revoked, _ := revokedTokenBox.BoolVal("sid:" + claims.SessionID); revoked {
+			return true
+		}
+	}
+
+	return false
+}
+
+// revokeAccessToken adds the access token to the denylist until it expires,
+// a token without `jti` can't be revoked, otherwise all such tokens would be revoked at once.
+func revokeAccessToken(claims *StandardClaims) error {
+	if "" == claims.Id {
+		return errNoTokenID
+	}
+
+	timeout := claims.ExpiresAt - time.Now().Unix() + 1
+	if timeout <= 0 {
+		return nil
+	}
+
+	return revokedTokenBox.SetBoolVal("jti:"+claims.Id, true, int(timeout))
+}
+
+// revokeOAuths deletes the refresh token records,
+// and revokes all access tokens issued from their families.
+func revokeOAuths(auths ...*ent.Oauth) error {
+	if 0 == len(auths) {
+		return nil
+	}
+
+	ids := make([]int, len(auths))
+	families := make(map[string]bool)
+	for i, auth := range auths {
+		ids[i] = auth.ID
+		if "" != auth.Family {
+			families[auth.Family] = true
+		}
+	}
+
+	_, err := client.Oauth.Delete().Where(oauth.IDIn(ids...)).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	for family := range families {
+		if err = revokedTokenBox.SetBoolVal("sid:"+family, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeUserOAuths revokes all refresh tokens and access tokens of the user, for all services
+func revokeUserOAuths(userID int) error {
+	auths, err := client.Oauth.Query().Where(oauth.HasUserWith(user.IDEQ(userID))).All(ctx)
+	if err != nil {
+		return err
+	}
+
+	return revokeOAuths(auths...)
+}
+
+// PostOAuthRevoke is the token revocation endpoint of RFC 7009,
+// both refresh tokens and access tokens can be revoked.
+func PostOAuthRevoke(c *Context) error {
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	token, err := c.GetFormString("token")
+	if err != nil {
+		return c.OAuthError(invalidRequest(err.Error()))
+	}
+
+	// The token_type_hint is only a hint, if the token isn't found as the hinted type,
+	// the other type is tried, see RFC 7009 §2.1
+	if "access_token" != c.PostForm("token_type_hint") {
+		auth, err := client.Oauth.Query().Where(oauth.MainTokenEQ(token)).WithService().Only(ctx)
+		if err == nil {
+			if auth.Edges.Service.ID != _service.ID {
+				return c.OAuthError(unauthorizedClient("The token was issued to another client"))
+			}
+			if err = revokeFamily(auth); err != nil {
+				return c.OAuthError(serverError(err))
+			}
+			return c.Ok("")
+		}
+	}
+
+	claims, err := FilterJWTToken(token, jwtKeys)
+	if err != nil {
+		// Invalid tokens, including expired or revoked tokens, don't cause an error response
+		return c.Ok("")
+	}
+
+	if claims.Audience != _service.ID {
+		return c.OAuthError(unauthorizedClient("The token was issued to another client"))
+	}
+
+	if err = revokeAccessToken(claims); err == errNoTokenID {
+		return c.Ok("")
+	} else if err != nil {
+		return c.OAuthError(serverError(err))
+	}
+
+	return c.Ok("")
+}
+
+// PostMainLogout ends the browser session of the request
+func PostMainLogout(c *Context) error {
+	if _, err := csrfSessionOf(c); err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	if err := endSession(c); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// PostMainLogoutAll logs out everywhere, it ends all browser sessions of the user,
+// and revokes all refresh tokens and access tokens of the user.
+func PostMainLogoutAll(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	if err = revokeUserOAuths(_user.ID); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	if err = endUserSessions(_user.ID); err != nil {
+		return c.InternalServerError(err.Error())
+	}
+	setSessionCookie(c, "", time.Time{})
+
+	return c.NoContent()
+}
@@ -1,34 +1,243 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/excing/goflag"
 )
 
+const timeoutSMTPDial = 10 * time.Second // SMTP server connection timeout: 10s
+
 // Send mail server domain
 var sesServer string
 
+// mailer sends the emails of whoam
+var mailer Mailer
+
 func init() {
 	goflag.Var(&sesServer, "ses", "Send mail server domain url")
 }
 
-// SendMail 发送短信
+// Mailer sends an HTML email
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// InitMailer initialize the mailer of config.Mailer
+func InitMailer() {
+	var err error
+	mailer, err = OpenMailer(config.Mailer)
+	if err != nil {
+		panic("failed to open mailer: " + err.Error())
+	}
+}
+
+// OpenMailer opens the mailer of the spec:
+// stdout, relay (the ses server), file:<dir>,
+// smtp://[user:password@]host[:port][?auth=plain|login] (STARTTLS if supported)
+// or smtps://[user:password@]host[:port][?auth=plain|login] (implicit TLS)
+func OpenMailer(spec string) (Mailer, error) {
+	if "" == spec || "stdout" == spec {
+		return &WriterMailer{os.Stdout, config.MailFrom}, nil
+	}
+	if "relay" == spec {
+		return &RelayMailer{sesServer}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		dir := u.Path
+		if "" == dir {
+			dir = u.Opaque
+		}
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{dir, config.MailFrom}, nil
+	case "smtp", "smtps":
+		m := &SMTPMailer{
+			Host:        u.Hostname(),
+			Port:        u.Port(),
+			ImplicitTLS: "smtps" == u.Scheme,
+			Auth:        strings.ToLower(u.Query().Get("auth")),
+			From:        config.MailFrom,
+		}
+		if "" == m.Port {
+			m.Port = "587"
+			if m.ImplicitTLS {
+				m.Port = "465"
+			}
+		}
+		if u.User != nil {
+			m.Username = u.User.Username()
+			m.Password, _ = u.User.Password()
+		}
+		if "" != m.Auth && "plain" != m.Auth && "login" != m.Auth {
+			return nil, fmt.Errorf("Unsupported SMTP auth: %v", m.Auth)
+		}
+
+		// STARTTLS is required by default, except for the server of the same host
+		switch starttls := strings.ToLower(u.Query().Get("starttls")); starttls {
+		case "required":
+			m.RequireSTARTTLS = true
+		case "optional":
+			m.RequireSTARTTLS = false
+		case "":
+			m.RequireSTARTTLS = !isLoopbackHost(m.Host)
+		default:
+			return nil, fmt.Errorf("Unsupported SMTP starttls: %v", starttls)
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported mailer: %v", spec)
+}
+
+// isLoopbackHost reports whether the host is localhost or a loopback IP
+func isLoopbackHost(host string) bool {
+	if "localhost" == strings.ToLower(host) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SendMail 发送邮件
 func SendMail(to string, subject string, body string) error {
+	return mailer.Send(to, subject, body)
+}
+
+// parseRecipient returns the address of the recipient, the line breaks which could inject headers are rejected
+func parseRecipient(to string) (*mail.Address, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return nil, fmt.Errorf("Invalid recipient: %q", to)
+	}
+	return mail.ParseAddress(to)
+}
+
+// buildMessage returns the RFC 5322 message of the HTML email
+func buildMessage(from string, to string, subject string, body string) ([]byte, error) {
+	rcpt, err := parseRecipient(to)
+	if err != nil {
+		return nil, err
+	}
+
+	toHeader := rcpt.Address
+	if "" != rcpt.Name {
+		toHeader = rcpt.String()
+	}
+
+	domain := "whoam.xyz"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		domain = addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+	}
+
+	var buf bytes.Buffer
+	header := [][2]string{
+		{"From", from},
+		{"To", toHeader},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + New32bitID() + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/html; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range header {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriterMailer writes the emails to the writer, such as stdout for development
+type WriterMailer struct {
+	Writer io.Writer
+	From   string
+}
+
+// Send implements Mailer
+func (m *WriterMailer) Send(to string, subject string, body string) error {
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Writer.Write(append(msg, '\r', '\n'))
+	return err
+}
+
+// FileMailer writes every email as a .eml file into the directory, for development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	name := time.Now().Format("20060102150405") + "-" + New16bitID() + ".eml"
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), msg, 0600)
+}
+
+// RelayMailer posts the emails to the ses server
+type RelayMailer struct {
+	Server string
+}
+
+// Send implements Mailer
+func (m *RelayMailer) Send(to string, subject string, body string) error {
+	rcpt, err := parseRecipient(to)
+	if err != nil {
+		return err
+	}
+
 	formData := url.Values{
-		"to":      {to},
+		"to":      {rcpt.Address},
 		"subject": {subject},
 		"body":    {body},
 	}
 
-	resp, err := http.PostForm(sesServer+"/v1/send/mail", formData)
+	resp, err := http.PostForm(m.Server+"/v1/send/mail", formData)
 
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if http.StatusNoContent == resp.StatusCode {
 		return nil
@@ -42,3 +251,142 @@ func SendMail(to string, subject string, body string) error {
 
 	return err
 }
+
+// SMTPMailer sends the emails to the SMTP server directly.
+// With implicit TLS, the connection is TLS from the start (usually port 465),
+// otherwise the connection is upgraded by STARTTLS (usually port 587).
+// If STARTTLS is required, the email isn't sent to a server without it,
+// otherwise the connection stays plaintext if the server doesn't support it.
+type SMTPMailer struct {
+	Host            string
+	Port            string
+	ImplicitTLS     bool
+	RequireSTARTTLS bool
+	Username        string
+	Password        string
+	Auth            string // plain (default) or login
+	From            string
+
+	// TLSConfig is the TLS configuration, the default verifies the certificate of the Host
+	TLSConfig *tls.Config
+}
+
+func (m *SMTPMailer) tlsConfig() *tls.Config {
+	if m.TLSConfig != nil {
+		return m.TLSConfig
+	}
+	return &tls.Config{ServerName: m.Host}
+}
+
+// Send implements Mailer
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	rcpt, err := parseRecipient(to)
+	if err != nil {
+		return err
+	}
+
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	dialer := &net.Dialer{Timeout: timeoutSMTPDial}
+
+	var conn net.Conn
+	if m.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, m.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !m.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(m.tlsConfig()); err != nil {
+				return err
+			}
+		} else if m.RequireSTARTTLS {
+			return errors.New("The SMTP server doesn't support STARTTLS")
+		}
+	}
+
+	if "" != m.Username {
+		var auth smtp.Auth
+		if "login" == m.Auth {
+			auth = &loginAuth{m.Username, m.Password, m.Host}
+		} else {
+			auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// loginAuth implements the AUTH LOGIN mechanism,
+// like smtp.PlainAuth, the password is only sent over TLS or to localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := "localhost" == server.Name || "127.0.0.1" == server.Name || "::1" == server.Name
+	if !server.TLS && !local {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
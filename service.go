@@ -1,12 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/grant"
+	"whoam.xyz/ent/oauth"
 	"whoam.xyz/ent/service"
+	"whoam.xyz/ent/user"
 )
 
 // InitService initialize service related business
 func InitService() {
-	_, err := client.Service.Query().Where(service.IDEQ(MainServiceID)).First(ctx)
+	_service, err := client.Service.Query().Where(service.IDEQ(MainServiceID)).First(ctx)
 	if err != nil {
 		_, err = client.Service.Create().
 			SetID(MainServiceID).
@@ -14,39 +24,443 @@ func InitService() {
 			SetSubject("Support OAuth authorization, support service registration, support RAS.").
 			SetDomain("https://www.whoam.xyz").
 			SetCloneURI("https://github.com/excing/whoam.git").
+			SetStatus(service.StatusVerified).
 			Save(ctx)
+	} else if service.StatusVerified != _service.Status {
+		// The domain of the main service is whoam itself
+		_, err = _service.Update().SetStatus(service.StatusVerified).Save(ctx)
+	}
 
-		if err != nil {
-			panic(err)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newClientSecret returns a new client secret and its hash,
+// only the hash is saved, the secret is shown to the service once.
+func newClientSecret() (string, string) {
+	secret := New64BitID()
+	return secret, hashClientSecret(secret)
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// isConfidential reports whether the service is a confidential client(RFC 6749 §2.1),
+// a confidential client must authenticate with its client secret.
+func isConfidential(s *ent.Service) bool {
+	return "" != s.SecretHash
+}
+
+// verifyClientSecret reports whether the secret is the current secret of the service,
+// or the previous secret within the overlap window after rotation.
+func verifyClientSecret(s *ent.Service, secret string) bool {
+	hash := []byte(hashClientSecret(secret))
+	if 1 == subtle.ConstantTimeCompare(hash, []byte(s.SecretHash)) {
+		return true
+	}
+
+	if "" == s.PreviousSecretHash || nil == s.PreviousSecretExpiredAt || s.PreviousSecretExpiredAt.Before(time.Now()) {
+		return false
+	}
+
+	return 1 == subtle.ConstantTimeCompare(hash, []byte(s.PreviousSecretHash))
+}
+
+// validRedirectURI reports whether the uri can be registered as a redirect URI,
+// it must be an absolute URI without fragment, see RFC 6749 §3.1.2
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && "" == u.Fragment
+}
+
+// invalidRedirectURI returns the first uri which can't be registered as a redirect URI, or empty if all are valid
+func invalidRedirectURI(uris []string) string {
+	for _, uri := range uris {
+		if !validRedirectURI(uri) {
+			return uri
 		}
 	}
+	return ""
+}
+
+// matchRedirectURI returns the registered redirect URI of the service that exactly matches the uri.
+// If the uri is empty and the service has only one registered redirect URI, it is returned.
+func matchRedirectURI(s *ent.Service, uri string) (string, bool) {
+	if "" == uri {
+		if 1 == len(s.RedirectUris) {
+			return s.RedirectUris[0], true
+		}
+		return "", false
+	}
+
+	for _, registered := range s.RedirectUris {
+		if registered == uri {
+			return uri, true
+		}
+	}
+
+	return "", false
+}
+
+// canManageService reports whether the user can modify the service, only its owner or administrators can.
+func canManageService(_user *ent.User, _service *ent.Service) bool {
+	if isAdmin(_user) {
+		return true
+	}
+	ownerID, err := _service.QueryOwner().OnlyID(ctx)
+	return err == nil && ownerID == _user.ID
+}
+
+// managedServiceOf returns the service of the id param, if the user of the request can manage it.
+// Otherwise the error response is written, and the service is nil.
+func managedServiceOf(c *Context) (*ent.Service, error) {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return nil, c.Unauthorized(err.Error())
+	}
+
+	_service, err := client.Service.Get(ctx, c.Param("id"))
+	if ent.IsNotFound(err) {
+		return nil, c.NotFound("Service not found")
+	}
+	if err != nil {
+		return nil, c.InternalServerError(err.Error())
+	}
+
+	if !canManageService(_user, _service) {
+		return nil, c.Forbidden("Only the owner of the service can manage it")
+	}
+
+	return _service, nil
 }
 
 // PostService 提交服务注册
 func PostService(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
 	var form struct {
-		ServiceID   string `json:"service_id" binding:"required"`
-		ServiceName string `json:"service_name" binding:"required"`
-		ServiceDesc string `json:"service_desc"`
-		Domain      string `json:"domain" binding:"required,url"`
-		CloneURI    string `json:"clone_uri" binding:"required"`
+		ServiceID    string   `json:"service_id" binding:"required"`
+		ServiceName  string   `json:"service_name" binding:"required"`
+		ServiceDesc  string   `json:"service_desc"`
+		Domain       string   `json:"domain" binding:"required,url"`
+		CloneURI     string   `json:"clone_uri" binding:"required"`
+		Public       bool     `json:"public" note:"Public clients(SPA, mobile apps) can't keep a client secret"`
+		RedirectURIs []string `json:"redirect_uris" binding:"required,min=1"`
+		RequirePKCE  bool     `json:"require_pkce" note:"The authorization request must have a code challenge(RFC 7636)"`
+		Scopes       []string `json:"scopes" note:"Custom scopes defined by the service, in addition to the standard scopes"`
+		SubjectType  string   `json:"subject_type" binding:"omitempty,oneof=public pairwise" note:"Subject identifiers of the users, the server default if empty"`
+
+		MaxSessionLifetime int `json:"max_session_lifetime" binding:"min=0" note:"Seconds, refresh tokens can't be refreshed beyond it since authorized, 0 is unlimited"`
 	}
-	err := c.ShouldBindJSON(&form)
+	err = c.ShouldBindJSON(&form)
 	if err != nil {
 		return c.BadRequest(err.Error())
 	}
 
-	_, err = client.Service.Create().
+	if uri := invalidRedirectURI(form.RedirectURIs); "" != uri {
+		return c.BadRequest("Invalid redirect_uri: %v", uri)
+	}
+
+	for _, scope := range form.Scopes {
+		if !validScope(scope) {
+			return c.BadRequest("Invalid scope: %v", scope)
+		}
+	}
+
+	creator := client.Service.Create().
 		SetID(form.ServiceID).
 		SetName(form.ServiceName).
 		SetSubject(form.ServiceDesc).
 		SetDomain(form.Domain).
 		SetCloneURI(form.CloneURI).
+		SetRedirectUris(form.RedirectURIs).
+		SetRequirePkce(form.RequirePKCE).
+		SetScopes(form.Scopes).
+		SetMaxSessionLifetime(form.MaxSessionLifetime).
+		SetOwner(_user)
+
+	if "" != form.SubjectType {
+		creator.SetSubjectType(service.SubjectType(form.SubjectType))
+	}
+
+	var secret, hash string
+	if !form.Public {
+		secret, hash = newClientSecret()
+		creator.SetSecretHash(hash)
+	}
+
+	_, err = creator.Save(ctx)
+
+	if ent.IsConstraintError(err) {
+		return c.Conflict("Service %v already exists", form.ServiceID)
+	}
+	if ent.IsValidationError(err) {
+		return c.BadRequest(err.Error())
+	}
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(
+		struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret,omitempty"`
+		}{
+			ClientID:     form.ServiceID,
+			ClientSecret: secret,
+		})
+}
+
+// GetServices lists the services owned by the user of the request
+func GetServices(c *Context) error {
+	_user, err := mainUserOf(c)
+	if err != nil {
+		return c.Unauthorized(err.Error())
+	}
+
+	offset, limit := c.Page()
+	services, err := client.Service.Query().
+		Where(service.HasOwnerWith(user.IDEQ(_user.ID))).
+		Order(ent.Asc(service.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(services)
+}
+
+// GetService returns the service to its owner or administrators
+func GetService(c *Context) error {
+	_service, err := managedServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	return c.Ok(_service)
+}
+
+// PatchService updates the fields of the service present in the request
+func PatchService(c *Context) error {
+	var form struct {
+		ServiceName  *string  `json:"service_name"`
+		ServiceDesc  *string  `json:"service_desc"`
+		Domain       *string  `json:"domain" binding:"omitempty,url"`
+		CloneURI     *string  `json:"clone_uri"`
+		RedirectURIs []string `json:"redirect_uris" binding:"omitempty,min=1"`
+		RequirePKCE  *bool    `json:"require_pkce"`
+		Scopes       []string `json:"scopes"`
+		SubjectType  *string  `json:"subject_type" note:"public or pairwise, empty is the server default; changing it changes the subjects of the users"`
+
+		MaxSessionLifetime *int `json:"max_session_lifetime" binding:"omitempty,min=0"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	_service, err := managedServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	updater := _service.Update()
+	if form.ServiceName != nil {
+		updater.SetName(*form.ServiceName)
+	}
+	if form.ServiceDesc != nil {
+		updater.SetSubject(*form.ServiceDesc)
+	}
+	if form.Domain != nil && *form.Domain != _service.Domain {
+		// The new domain must be verified again
+		updater.SetDomain(*form.Domain).
+			SetStatus(service.StatusUnverified).
+			ClearVerifiedAt().
+			SetCheckFailures(0)
+	}
+	if form.CloneURI != nil {
+		updater.SetCloneURI(*form.CloneURI)
+	}
+	if form.RedirectURIs != nil {
+		// The owner can change the redirect URIs of any service, see redirectURIsServiceOf
+		if uri := invalidRedirectURI(form.RedirectURIs); "" != uri {
+			return c.BadRequest("Invalid redirect_uri: %v", uri)
+		}
+		updater.SetRedirectUris(form.RedirectURIs)
+	}
+	if form.RequirePKCE != nil {
+		updater.SetRequirePkce(*form.RequirePKCE)
+	}
+	if form.Scopes != nil {
+		for _, scope := range form.Scopes {
+			if !validScope(scope) {
+				return c.BadRequest("Invalid scope: %v", scope)
+			}
+		}
+		updater.SetScopes(form.Scopes)
+	}
+	if form.MaxSessionLifetime != nil {
+		updater.SetMaxSessionLifetime(*form.MaxSessionLifetime)
+	}
+	if form.SubjectType != nil {
+		if "" == *form.SubjectType {
+			updater.ClearSubjectType()
+		} else {
+			updater.SetSubjectType(service.SubjectType(*form.SubjectType))
+		}
+	}
+
+	_service, err = updater.Save(ctx)
+	if ent.IsValidationError(err) {
+		return c.BadRequest(err.Error())
+	}
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.Ok(_service)
+}
+
+// DeleteService deletes the service, and the OAuth authorizations and grants of it
+func DeleteService(c *Context) error {
+	_service, err := managedServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	if MainServiceID == _service.ID {
+		return c.Forbidden("The main service can't be deleted")
+	}
+
+	err = deleteService(_service.ID)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
+	return c.NoContent()
+}
+
+// deleteService deletes the service with its OAuth authorizations and grants in a transaction.
+// The authorizations are revoked first, so that the access tokens issued from them are rejected too.
+func deleteService(id string) error {
+	auths, err := client.Oauth.Query().Where(oauth.HasServiceWith(service.IDEQ(id))).All(ctx)
+	if err != nil {
+		return err
+	}
+	if err = revokeOAuths(auths...); err != nil {
+		return err
+	}
+
+	return WithTx(ctx, client, func(tx *ent.Tx) error {
+		_, err := tx.Oauth.Delete().Where(oauth.HasServiceWith(service.IDEQ(id))).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Grant.Delete().Where(grant.HasServiceWith(service.IDEQ(id))).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Service.DeleteOneID(id).Exec(ctx)
+	})
+}
+
+// PostServiceSecret rotates the client secret of the confidential service,
+// the previous secret remains valid within the overlap window.
+func PostServiceSecret(c *Context) error {
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return c.OAuthError(oe)
+	}
+
+	if _service.ID != c.Param("id") {
+		return c.Forbidden("Can't rotate the secret of another service")
+	}
+
+	if !isConfidential(_service) {
+		return c.BadRequest("Public service has no client secret")
+	}
+
+	secret, hash := newClientSecret()
+
+	_, err := _service.Update().
+		SetSecretHash(hash).
+		SetPreviousSecretHash(_service.SecretHash).
+		SetPreviousSecretExpiredAt(time.Now().Add(time.Duration(config.SecretOverlap) * time.Hour)).
 		Save(ctx)
 
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
+	return c.Ok(
+		struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}{
+			ClientID:     _service.ID,
+			ClientSecret: secret,
+		})
+}
+
+// redirectURIsServiceOf returns the service of the id param, if the request can change its redirect URIs:
+// the owner of the service or administrators, or the confidential service itself with its client secret.
+// A public service can't change its own redirect URIs, its client_id isn't a secret.
+// Otherwise the error response is written, and the service is nil.
+func redirectURIsServiceOf(c *Context) (*ent.Service, error) {
+	if _, _, basic := c.Request.BasicAuth(); !basic {
+		return managedServiceOf(c)
+	}
+
+	_service, oe := authenticateClient(c)
+	if oe != nil {
+		return nil, c.OAuthError(oe)
+	}
+
+	if _service.ID != c.Param("id") {
+		return nil, c.Forbidden("Can't modify the redirect URIs of another service")
+	}
+
+	if !isConfidential(_service) {
+		return nil, c.Forbidden("Only the owner can modify the redirect URIs of a public service")
+	}
+
+	return _service, nil
+}
+
+// PutServiceRedirectURIs replaces the registered redirect URIs of the service,
+// it's requested by the owner of the service, or the confidential service with HTTP Basic authentication.
+func PutServiceRedirectURIs(c *Context) error {
+	var form struct {
+		RedirectURIs []string `json:"redirect_uris" binding:"required,min=1"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil {
+		return c.BadRequest(err.Error())
+	}
+
+	_service, err := redirectURIsServiceOf(c)
+	if _service == nil {
+		return err
+	}
+
+	if uri := invalidRedirectURI(form.RedirectURIs); "" != uri {
+		return c.BadRequest("Invalid redirect_uri: %v", uri)
+	}
+
+	_, err = _service.Update().SetRedirectUris(form.RedirectURIs).Save(ctx)
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
+
 	return c.NoContent()
 }
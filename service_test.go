@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/grant"
+	"whoam.xyz/ent/oauth"
+	"whoam.xyz/ent/service"
+)
+
+func TestVerifyClientSecret(t *testing.T) {
+	secret, hash := newClientSecret()
+	previous, previousHash := newClientSecret()
+	expiredAt := time.Now().Add(time.Hour)
+
+	s := &ent.Service{SecretHash: hash, PreviousSecretHash: previousHash, PreviousSecretExpiredAt: &expiredAt}
+	if !verifyClientSecret(s, secret) {
+		t.Error("current secret should be valid")
+	}
+	if !verifyClientSecret(s, previous) {
+		t.Error("previous secret should be valid within the overlap window")
+	}
+	if verifyClientSecret(s, New64BitID()) {
+		t.Error("unknown secret should be invalid")
+	}
+
+	expiredAt = time.Now().Add(-time.Second)
+	if verifyClientSecret(s, previous) {
+		t.Error("previous secret should be invalid after the overlap window")
+	}
+}
+
+func TestMatchRedirectURI(t *testing.T) {
+	s := &ent.Service{RedirectUris: []string{"https://example.com/callback"}}
+
+	if uri, ok := matchRedirectURI(s, ""); !ok || uri != "https://example.com/callback" {
+		t.Error("the only registered redirect URI should be used if omitted")
+	}
+	if _, ok := matchRedirectURI(s, "https://example.com/callback/"); ok {
+		t.Error("redirect URI must match exactly")
+	}
+	if _, ok := matchRedirectURI(s, "https://example.com/callback?next=evil.com"); ok {
+		t.Error("redirect URI must match exactly")
+	}
+
+	s.RedirectUris = append(s.RedirectUris, "https://example.com/other")
+	if _, ok := matchRedirectURI(s, ""); ok {
+		t.Error("redirect URI can't be omitted if more than one is registered")
+	}
+}
+
+func TestCanManageService(t *testing.T) {
+	setupOAuth(t)
+
+	owner, err := client.User.Create().SetEmail("owner@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := client.User.Create().SetEmail("other@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_service, err := client.Service.Create().
+		SetID("owned.example.com").
+		SetName("owned").
+		SetSubject("").
+		SetDomain("https://owned.example.com").
+		SetCloneURI("https://github.com/excing/whoam.git").
+		SetOwner(owner).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !canManageService(owner, _service) {
+		t.Error("the owner should manage the service")
+	}
+	if canManageService(other, _service) {
+		t.Error("other users shouldn't manage the service")
+	}
+
+	admins := config.Admins
+	defer func() { config.Admins = admins }()
+	config.Admins = "root@example.com, other@example.com"
+	if !canManageService(other, _service) {
+		t.Error("administrators should manage the service")
+	}
+}
+
+func TestDeleteServiceCascade(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("cascade@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_service, err := client.Service.Create().
+		SetID("cascade.example.com").
+		SetName("cascade").
+		SetSubject("").
+		SetDomain("https://cascade.example.com").
+		SetCloneURI("https://github.com/excing/whoam.git").
+		SetOwner(_user).
+		Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken, _, err := newOAuthToken(_user.ID, _service.ID, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = newOAuthToken(_user.ID, MainServiceID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = saveGrant(_user.ID, _service.ID, []string{"openid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = deleteService(_service.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if exist, _ := client.Service.Query().Where(service.IDEQ(_service.ID)).Exist(ctx); exist {
+		t.Error("the service should be deleted")
+	}
+	if n, _ := client.Oauth.Query().Where(oauth.HasServiceWith(service.IDEQ(_service.ID))).Count(ctx); 0 != n {
+		t.Error("the authorizations of the service should be deleted", n)
+	}
+	if n, _ := client.Grant.Query().Where(grant.HasServiceWith(service.IDEQ(_service.ID))).Count(ctx); 0 != n {
+		t.Error("the grants of the service should be deleted", n)
+	}
+	if _, err = FilterJWTToken(accessToken, jwtKeys); err == nil {
+		t.Error("the access tokens of the service should be revoked")
+	}
+	if n, _ := client.Oauth.Query().Where(oauth.HasServiceWith(service.IDEQ(MainServiceID))).Count(ctx); 0 == n {
+		t.Error("the authorizations of other services should be kept")
+	}
+}
+
+func TestPutServiceRedirectURIs(t *testing.T) {
+	setupOAuth(t)
+
+	owner, err := client.User.Create().SetEmail("redirect.owner@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerToken, _, err := newOAuthToken(owner.ID, MainServiceID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	confidential, secret := createConfidentialService(t, "confidential.redirect.example.com")
+	public := createSubjectService(t, "public.redirect.example.com", "")
+	for _, _service := range []*ent.Service{confidential, public} {
+		if _, err = _service.Update().SetOwner(owner).Save(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// put requests to replace the redirect URIs of the service, with the authorization of the request
+	put := func(id string, uri string, authorize func(r *http.Request)) int {
+		body, _ := json.Marshal(map[string][]string{"redirect_uris": {uri}})
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("PUT", "/api/v1/service/"+id+"/redirect_uris", bytes.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		authorize(c.Request)
+		PutServiceRedirectURIs(&Context{c})
+		return w.Code
+	}
+	redirectURIsOf := func(id string) []string {
+		return client.Service.GetX(ctx, id).RedirectUris
+	}
+
+	// The owner changes the redirect URIs of any service, as PatchService
+	for _, id := range []string{confidential.ID, public.ID} {
+		uri := "https://" + id + "/owner"
+		status := put(id, uri, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+ownerToken) })
+		if http.StatusNoContent != status || 1 != len(redirectURIsOf(id)) || uri != redirectURIsOf(id)[0] {
+			t.Error("the owner should change the redirect URIs", id, status, redirectURIsOf(id))
+		}
+	}
+
+	// The confidential service changes its own redirect URIs with its client secret
+	uri := "https://confidential.redirect.example.com/client"
+	if status := put(confidential.ID, uri, func(r *http.Request) { r.SetBasicAuth(confidential.ID, secret) }); http.StatusNoContent != status || uri != redirectURIsOf(confidential.ID)[0] {
+		t.Error("the confidential service should change its redirect URIs", status)
+	}
+	if status := put(confidential.ID, "https://evil.example.com/", func(r *http.Request) { r.SetBasicAuth(confidential.ID, "wrong") }); http.StatusUnauthorized != status {
+		t.Error("the wrong client secret should be unauthorized", status)
+	}
+
+	// The public service can't change its own redirect URIs, its client_id isn't a secret
+	if status := put(public.ID, "https://evil.example.com/", func(r *http.Request) { r.SetBasicAuth(public.ID, "") }); http.StatusForbidden != status {
+		t.Error("the public service shouldn't change its redirect URIs", status)
+	}
+	if "https://public.redirect.example.com/owner" != redirectURIsOf(public.ID)[0] {
+		t.Error("the redirect URIs of the public service shouldn't be changed", redirectURIsOf(public.ID))
+	}
+}
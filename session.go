@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/session"
+	"whoam.xyz/ent/user"
+)
+
+const sessionCookie = "whoam_session"         // name of the cookie of the browser session
+const csrfHeader = "X-CSRF-Token"             // header of the CSRF token of state-changing requests
+const intervalSessionTouch = time.Minute      // the last used time is updated at most once: 1min
+const intervalSessionPurge = 10 * time.Minute // purge the ended sessions: 10min
+
+var errNoSession = errors.New("Unauthorized")
+var errInvalidCSRFToken = errors.New("Invalid CSRF token, please reload the page")
+
+// InitSession purges the ended sessions every intervalSessionPurge
+func InitSession() {
+	go func() {
+		for range time.Tick(intervalSessionPurge) {
+			if err := purgeSessions(); err != nil {
+				log.Println("failed to purge sessions:", err)
+			}
+		}
+	}()
+}
+
+func sessionIdleTimeout() time.Duration {
+	return time.Duration(config.SessionIdleTimeout) * time.Minute
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSession starts a browser session of the user, and sets the session cookie.
+// The previous session of the browser is ended, so that a planted session can't be used.
+func newSession(c *Context, userID int) (*ent.Session, error) {
+	if err := deleteSession(c); err != nil {
+		return nil, err
+	}
+
+	token := RandEntropyString(config.TokenEntropy)
+	expiredAt := time.Now().Add(time.Duration(config.SessionLifetime) * time.Hour)
+
+	_session, err := client.Session.Create().
+		SetUserID(userID).
+		SetExpiredAt(expiredAt).
+		SetTokenHash(hashSessionToken(token)).
+		SetCsrfToken(New64BitID()).
+		SetUserAgent(c.Request.UserAgent()).
+		SetIP(clientIP(c)).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	setSessionCookie(c, token, expiredAt)
+	return _session, nil
+}
+
+// setSessionCookie sets the session cookie, it's HttpOnly so that scripts can't read it,
+// and SameSite=Lax so that it's sent by the top-level navigation from the services.
+// The cookie is deleted if the token is empty.
+func setSessionCookie(c *Context, token string, expiredAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiredAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if "" == token {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// sessionOf returns the active browser session of the request with its user, or nil.
+// A session is ended after the idle timeout since it was last used, or after its lifetime.
+func sessionOf(c *Context) *ent.Session {
+	if cached, ok := c.Get("session"); ok {
+		return cached.(*ent.Session)
+	}
+
+	_session := loadSession(c)
+	c.Set("session", _session)
+	return _session
+}
+
+func loadSession(c *Context) *ent.Session {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil || "" == token {
+		return nil
+	}
+
+	now := time.Now()
+	_session, err := client.Session.Query().
+		Where(session.TokenHashEQ(hashSessionToken(token))).
+		Where(session.ExpiredAtGT(now)).
+		Where(session.LastUsedAtGT(now.Add(-sessionIdleTimeout()))).
+		WithUser().
+		Only(ctx)
+	if err != nil {
+		return nil
+	}
+
+	if now.Sub(_session.LastUsedAt) > intervalSessionTouch {
+		if err = _session.Update().SetLastUsedAt(now).Exec(ctx); err != nil {
+			log.Println("failed to touch session:", err)
+		}
+	}
+	return _session
+}
+
+// csrfSessionOf returns the session of the state-changing request,
+// the request must have the CSRF token of the session in the X-CSRF-Token header or the csrf_token form.
+func csrfSessionOf(c *Context) (*ent.Session, error) {
+	_session := sessionOf(c)
+	if _session == nil {
+		return nil, errNoSession
+	}
+
+	token := c.GetHeader(csrfHeader)
+	if "" == token {
+		token = c.PostForm("csrf_token")
+	}
+	if !equalString(token, _session.CsrfToken) {
+		return nil, errInvalidCSRFToken
+	}
+	return _session, nil
+}
+
+// endSession ends the browser session of the request, and deletes the session cookie
+func endSession(c *Context) error {
+	if err := deleteSession(c); err != nil {
+		return err
+	}
+
+	setSessionCookie(c, "", time.Time{})
+	return nil
+}
+
+// deleteSession deletes the browser session of the session cookie of the request
+func deleteSession(c *Context) error {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil || "" == token {
+		return nil
+	}
+
+	_, err = client.Session.Delete().Where(session.TokenHashEQ(hashSessionToken(token))).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.Set("session", (*ent.Session)(nil))
+	return nil
+}
+
+// endUserSessions ends all browser sessions of the user
+func endUserSessions(userID int) error {
+	_, err := client.Session.Delete().Where(session.HasUserWith(user.IDEQ(userID))).Exec(ctx)
+	return err
+}
+
+// purgeSessions deletes the ended sessions
+func purgeSessions() error {
+	now := time.Now()
+	_, err := client.Session.Delete().
+		Where(session.Or(
+			session.ExpiredAtLTE(now),
+			session.LastUsedAtLTE(now.Add(-sessionIdleTimeout())),
+		)).
+		Exec(ctx)
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"whoam.xyz/ent"
+)
+
+// newSessionContext returns the context of the request with the cookies
+func newSessionContext(method string, cookies ...*http.Cookie) (*Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/", nil)
+	for _, cookie := range cookies {
+		c.Request.AddCookie(cookie)
+	}
+	return &Context{c}, w
+}
+
+// loginSession starts a session of a new user, and returns the session and its cookie
+func loginSession(t *testing.T, email string) (*ent.Session, *http.Cookie) {
+	_user, err := client.User.Create().SetEmail(email).Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := newSessionContext("POST")
+	_session, err := newSession(c, _user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if 1 != len(cookies) {
+		t.Fatal("the session cookie should be set", cookies)
+	}
+	return _session, cookies[0]
+}
+
+func TestSessionCookie(t *testing.T) {
+	setupOAuth(t)
+
+	_, cookie := loginSession(t, "cookie@example.com")
+	if sessionCookie != cookie.Name || !cookie.HttpOnly || !cookie.Secure || http.SameSiteLaxMode != cookie.SameSite {
+		t.Error("the session cookie should be HttpOnly, Secure and SameSite", cookie)
+	}
+
+	c, _ := newSessionContext("GET", cookie)
+	_session := sessionOf(c)
+	if _session == nil || "cookie@example.com" != _session.Edges.User.Email {
+		t.Fatal("the session of the cookie should be active")
+	}
+
+	c, w := newSessionContext("POST", cookie)
+	if err := endSession(c); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := w.Result().Cookies(); 1 != len(cookies) || 0 <= cookies[0].MaxAge {
+		t.Error("the session cookie should be deleted", cookies)
+	}
+
+	c, _ = newSessionContext("GET", cookie)
+	if sessionOf(c) != nil {
+		t.Error("the ended session shouldn't be active")
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	setupOAuth(t)
+
+	idle, idleCookie := loginSession(t, "idle@example.com")
+	err := idle.Update().SetLastUsedAt(time.Now().Add(-sessionIdleTimeout() - time.Minute)).Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := newSessionContext("GET", idleCookie)
+	if sessionOf(c) != nil {
+		t.Error("the session should be ended after the idle timeout")
+	}
+
+	// The absolute lifetime can't be extended by activity
+	_, lifetimeCookie := loginSession(t, "active@example.com")
+	lifetime := config.SessionLifetime
+	defer func() { config.SessionLifetime = lifetime }()
+	config.SessionLifetime = 0
+	expired, expiredCookie := loginSession(t, "expired@example.com")
+	c, _ = newSessionContext("GET", expiredCookie)
+	if sessionOf(c) != nil {
+		t.Error("the session should be ended after its lifetime", expired.ExpiredAt)
+	}
+
+	if err = purgeSessions(); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newSessionContext("GET", lifetimeCookie)
+	if sessionOf(c) == nil {
+		t.Error("the active session shouldn't be purged")
+	}
+}
+
+func TestSessionCSRF(t *testing.T) {
+	setupOAuth(t)
+
+	_session, cookie := loginSession(t, "csrf@example.com")
+
+	c, _ := newSessionContext("GET", cookie)
+	if _user, err := mainUserOf(c); err != nil || "csrf@example.com" != _user.Email {
+		t.Error("the safe request of the session should be authenticated", err)
+	}
+
+	c, _ = newSessionContext("POST", cookie)
+	if _, err := mainUserOf(c); err != errInvalidCSRFToken {
+		t.Error("the state-changing request without CSRF token should be rejected", err)
+	}
+
+	c, _ = newSessionContext("POST", cookie)
+	c.Request.Header.Set(csrfHeader, New64BitID())
+	if _, err := mainUserOf(c); err != errInvalidCSRFToken {
+		t.Error("the state-changing request with a wrong CSRF token should be rejected", err)
+	}
+
+	c, _ = newSessionContext("POST", cookie)
+	c.Request.Header.Set(csrfHeader, _session.CsrfToken)
+	if _user, err := mainUserOf(c); err != nil || "csrf@example.com" != _user.Email {
+		t.Error("the state-changing request with the CSRF token should be authenticated", err)
+	}
+
+	c, _ = newSessionContext("POST")
+	if _, err := mainUserOf(c); err != errNoSession {
+		t.Error("the request without session should be rejected", err)
+	}
+}
+
+func TestLoginMainTokens(t *testing.T) {
+	setupOAuth(t)
+
+	c, w := newSessionContext("POST")
+	if err := loginMain(c, "login.tokens@example.com"); err != nil || http.StatusOK != w.Code {
+		t.Fatal("the user should be logged in", w.Code, err)
+	}
+	if 1 != len(w.Result().Cookies()) {
+		t.Error("the session cookie should be set", w.Result().Cookies())
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if "" == response["csrfToken"] || "" == response["mainToken"] {
+		t.Error("the CSRF token and the refresh token should be returned", response)
+	}
+
+	// The API client authenticates with the access token, without cookies and CSRF token
+	c, _ = newSessionContext("POST")
+	c.Request.Header.Set("Authorization", "Bearer "+response["accessToken"])
+	if _user, err := mainUserOf(c); err != nil || "login.tokens@example.com" != _user.Email {
+		t.Error("the request with the whoam access token should be authenticated", err)
+	}
+
+	accessToken, err := NewJWTToken(0, exampleService, "", "", timeoutAccessToken, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newSessionContext("POST")
+	c.Request.Header.Set("Authorization", "Bearer "+accessToken)
+	if _, err = mainUserOf(c); err == nil {
+		t.Error("the access token of another service should be rejected")
+	}
+}
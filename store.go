@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/keyvalue"
+)
+
+const intervalStorePurge = 10 * time.Minute // purge expired entries of the database store: 10min
+
+// ErrNotFound is returned if the key doesn't exist or has expired
+var ErrNotFound = errors.New("Entry not found")
+
+// KVStore is the storage of the short-lived values of Box, such as verification codes and OAuth codes.
+// The ttl is in seconds, and the entry never expires if the ttl is 0.
+type KVStore interface {
+	Set(key string, val []byte, ttl int) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// GetAndDelete returns and deletes the value atomically,
+	// only one of the concurrent calls of a key gets the value.
+	GetAndDelete(key string) ([]byte, error)
+	// Incr increments the decimal integer value atomically and returns it,
+	// the value starts from 0 with the ttl if the key doesn't exist, otherwise the ttl isn't changed.
+	Incr(key string, ttl int) (int64, error)
+}
+
+// kvStore is the store shared by all boxes, the boxes are distinguished by key prefixes.
+var kvStore KVStore
+
+// dbStore is the database store, its entries are never evicted before they expire,
+// it keeps the entries which must not be lost, such as the denylist of revoked tokens.
+var dbStore KVStore
+
+// stopStorePurge stops purging the expired entries of dbStore
+var stopStorePurge context.CancelFunc = func() {}
+
+// InitStore opens the KVStore of config.Store, and the database store,
+// and purges the expired entries of the database store every intervalStorePurge.
+func InitStore() {
+	var err error
+	kvStore, err = OpenKVStore(config.Store)
+	if err != nil {
+		panic("failed to open store: " + err.Error())
+	}
+
+	store, ok := kvStore.(*EntStore)
+	if !ok {
+		store = NewEntStore(client)
+	}
+	dbStore = store
+
+	// Only the purge of the current database store is running
+	stopStorePurge()
+	var purgeCtx context.Context
+	purgeCtx, stopStorePurge = context.WithCancel(context.Background())
+	go store.PurgeEvery(purgeCtx, intervalStorePurge)
+}
+
+// OpenKVStore opens the store of the spec:
+// memory, db (the whoam database) or redis://[:password@]host:port[/db]
+func OpenKVStore(spec string) (KVStore, error) {
+	switch {
+	case "" == spec || "memory" == spec:
+		// size: 10M
+		return NewMemoryStore(10 * 1024 * 1024), nil
+	case "db" == spec:
+		return NewEntStore(client), nil
+	case strings.HasPrefix(spec, "redis://"):
+		return NewRedisStore(spec)
+	}
+
+	return nil, errors.Errorf("Unsupported store: %v", spec)
+}
+
+// MemoryStore is a KVStore in the memory of the process
+type MemoryStore struct {
+	sync.Mutex
+	cache *freecache.Cache
+}
+
+// NewMemoryStore returns a memory store of the size in bytes
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{cache: freecache.NewCache(size)}
+}
+
+// Set implements KVStore
+func (s *MemoryStore) Set(key string, val []byte, ttl int) error {
+	return s.cache.Set([]byte(key), val, ttl)
+}
+
+// Get implements KVStore
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	val, err := s.cache.Get([]byte(key))
+	if err == freecache.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+// Delete implements KVStore
+func (s *MemoryStore) Delete(key string) error {
+	s.cache.Del([]byte(key))
+	return nil
+}
+
+// GetAndDelete implements KVStore
+func (s *MemoryStore) GetAndDelete(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	val, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.cache.Del([]byte(key)) {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// Incr implements KVStore
+func (s *MemoryStore) Incr(key string, ttl int) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	val, expireAt, err := s.cache.GetWithExpiration([]byte(key))
+	if err == freecache.ErrNotFound {
+		return 1, s.cache.Set([]byte(key), []byte("1"), ttl)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep the expiration of the entry
+	if 0 != expireAt {
+		ttl = int(int64(expireAt) - time.Now().Unix())
+		if ttl < 1 {
+			ttl = 1
+		}
+	} else {
+		ttl = 0
+	}
+	return n + 1, s.cache.Set([]byte(key), []byte(strconv.FormatInt(n+1, 10)), ttl)
+}
+
+// EntStore is a KVStore in the KeyValue table of the database,
+// it can be shared by whoam servers of the same database.
+type EntStore struct {
+	client *ent.Client
+}
+
+// NewEntStore returns a database store of the client
+func NewEntStore(client *ent.Client) *EntStore {
+	return &EntStore{client}
+}
+
+// Set implements KVStore
+func (s *EntStore) Set(key string, val []byte, ttl int) error {
+	ctx := context.Background()
+
+	return WithTx(ctx, s.client, func(tx *ent.Tx) error {
+		_, err := tx.KeyValue.Delete().Where(keyvalue.IDEQ(key)).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		create := tx.KeyValue.Create().SetID(key).SetValue(val)
+		if 0 < ttl {
+			create.SetExpiredAt(time.Now().Add(time.Duration(ttl) * time.Second))
+		}
+		_, err = create.Save(ctx)
+		return err
+	})
+}
+
+// Get implements KVStore
+func (s *EntStore) Get(key string) ([]byte, error) {
+	kv, err := s.client.KeyValue.Get(context.Background(), key)
+	if ent.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if kv.ExpiredAt != nil && kv.ExpiredAt.Before(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return kv.Value, nil
+}
+
+// Delete implements KVStore
+func (s *EntStore) Delete(key string) error {
+	_, err := s.client.KeyValue.Delete().Where(keyvalue.IDEQ(key)).Exec(context.Background())
+	return err
+}
+
+// GetAndDelete implements KVStore,
+// the entry is deleted only if it still has the value and hasn't expired,
+// so the value is only returned to the call which actually deletes it.
+func (s *EntStore) GetAndDelete(key string) ([]byte, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := s.client.KeyValue.Delete().
+		Where(
+			keyvalue.IDEQ(key),
+			keyvalue.ValueEQ(val),
+			keyvalue.Or(keyvalue.ExpiredAtIsNil(), keyvalue.ExpiredAtGT(time.Now())),
+		).
+		Exec(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if 0 == n {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// Incr implements KVStore,
+// the value is compared and set, and it's retried if another call has changed the value.
+func (s *EntStore) Incr(key string, ttl int) (int64, error) {
+	ctx := context.Background()
+
+	for {
+		val, err := s.Get(key)
+		if err == ErrNotFound {
+			err = WithTx(ctx, s.client, func(tx *ent.Tx) error {
+				_, err := tx.KeyValue.Delete().Where(keyvalue.IDEQ(key), keyvalue.ExpiredAtLT(time.Now())).Exec(ctx)
+				if err != nil {
+					return err
+				}
+
+				create := tx.KeyValue.Create().SetID(key).SetValue([]byte("1"))
+				if 0 < ttl {
+					create.SetExpiredAt(time.Now().Add(time.Duration(ttl) * time.Second))
+				}
+				_, err = create.Save(ctx)
+				return err
+			})
+			// Another call has created the entry
+			if ent.IsConstraintError(errors.Cause(err)) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		updated, err := s.client.KeyValue.Update().
+			Where(keyvalue.IDEQ(key), keyvalue.ValueEQ(val)).
+			SetValue([]byte(strconv.FormatInt(n+1, 10))).
+			Save(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if 1 == updated {
+			return n + 1, nil
+		}
+	}
+}
+
+// Purge deletes the expired entries
+func (s *EntStore) Purge() error {
+	_, err := s.client.KeyValue.Delete().
+		Where(keyvalue.ExpiredAtLT(time.Now())).
+		Exec(context.Background())
+	return err
+}
+
+// PurgeEvery purges the expired entries every interval until the context is done
+func (s *EntStore) PurgeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Purge(); err != nil {
+				log.Println("failed to purge expired entries:", err)
+			}
+		}
+	}
+}
+
+const timeoutRedisDial = 5 * time.Second    // timeout of connecting to the Redis server: 5s
+const timeoutRedisCommand = 5 * time.Second // read and write deadline of a command: 5s
+const maxRedisIdleConns = 16                // idle connections kept in the pool: 16
+
+// RedisStore is a KVStore of a Redis server with the RESP protocol,
+// it can be shared by whoam servers of the same Redis.
+// GetAndDelete uses GETDEL of Redis 6.2 or later, and falls back to GET and DEL in a transaction on older servers.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+
+	idle     chan *redisConn // the pool of idle connections
+	noGetDel int32           // 1 if the server doesn't support GETDEL
+}
+
+// redisConn is an authenticated connection to the database of the Redis server
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisStore returns a Redis store of the redis://[:password@]host:port[/db] URL
+func NewRedisStore(rawurl string) (*RedisStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RedisStore{addr: u.Host, idle: make(chan *redisConn, maxRedisIdleConns)}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); "" != db {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("Invalid Redis database: %v", db)
+		}
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.put(conn)
+	return s, nil
+}
+
+// dial connects to the Redis server, and authenticates and selects the database
+func (s *RedisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, timeoutRedisDial)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	if "" != s.password {
+		if _, err = c.roundTrip("AUTH", s.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if 0 != s.db {
+		if _, err = c.roundTrip("SELECT", strconv.Itoa(s.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// get returns an idle connection of the pool, or a new connection
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+// put returns the connection to the pool, it's closed if the pool is full
+func (s *RedisStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// with calls fn with a connection of the pool,
+// the connection is closed instead of returned to the pool if fn fails other than an error reply.
+func (s *RedisStore) with(fn func(c *redisConn) (interface{}, error)) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := fn(c)
+	if _, ok := err.(redisError); !ok && err != nil {
+		c.Close()
+	} else {
+		s.put(c)
+	}
+	return reply, err
+}
+
+// do sends the command and returns the reply
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	return s.with(func(c *redisConn) (interface{}, error) {
+		return c.roundTrip(args...)
+	})
+}
+
+// roundTrip sends the command and reads the reply within timeoutRedisCommand
+func (c *redisConn) roundTrip(args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(timeoutRedisCommand)); err != nil {
+		return nil, err
+	}
+	if err := writeRESP(c, args...); err != nil {
+		return nil, err
+	}
+	return readRESP(c.reader)
+}
+
+// Set implements KVStore
+func (s *RedisStore) Set(key string, val []byte, ttl int) error {
+	args := []string{"SET", key, string(val)}
+	if 0 < ttl {
+		args = append(args, "EX", strconv.Itoa(ttl))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// Get implements KVStore
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	return bulkReply(s.do("GET", key))
+}
+
+// Delete implements KVStore
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+// GetAndDelete implements KVStore
+func (s *RedisStore) GetAndDelete(key string) ([]byte, error) {
+	if 0 == atomic.LoadInt32(&s.noGetDel) {
+		val, err := bulkReply(s.do("GETDEL", key))
+		if e, ok := err.(redisError); !ok || !strings.HasPrefix(string(e), "ERR unknown command") {
+			return val, err
+		}
+		atomic.StoreInt32(&s.noGetDel, 1)
+	}
+
+	// GET and DEL in a transaction of Redis before 6.2, the connection is closed on errors so the transaction is discarded
+	reply, err := s.with(func(c *redisConn) (interface{}, error) {
+		for _, args := range [][]string{{"MULTI"}, {"GET", key}, {"DEL", key}} {
+			if _, err := c.roundTrip(args...); err != nil {
+				return nil, errors.WithMessage(err, args[0])
+			}
+		}
+		return c.roundTrip("EXEC")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replies, ok := reply.([]interface{})
+	if !ok || 2 != len(replies) {
+		return nil, errors.Errorf("Unexpected Redis reply: %v", reply)
+	}
+	return bulkReply(replies[0], nil)
+}
+
+// redisIncrScript increments the key and sets the ttl if the key is created by the increment,
+// the script runs atomically, so the key never exists without the ttl.
+const redisIncrScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return n`
+
+// Incr implements KVStore
+func (s *RedisStore) Incr(key string, ttl int) (int64, error) {
+	reply, err := s.do("EVAL", redisIncrScript, "1", key, strconv.Itoa(ttl))
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errors.Errorf("Unexpected Redis reply: %v", reply)
+	}
+	return n, nil
+}
+
+// redisError is an error reply of the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// bulkReply returns the bytes of a bulk string reply, a nil reply is ErrNotFound
+func bulkReply(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	val, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.Errorf("Unexpected Redis reply: %v", reply)
+	}
+	return val, nil
+}
+
+// writeRESP writes the command as an array of bulk strings, see https://redis.io/topics/protocol
+func writeRESP(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readRESP reads a reply: string for simple strings, int64 for integers,
+// []byte or nil for bulk strings, []interface{} or nil for arrays, and redisError for errors.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.Errorf("Invalid RESP line: %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+
+	return nil, errors.Errorf("Invalid RESP type: %q", kind)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"whoam.xyz/ent/keyvalue"
+)
+
+// testKVStore tests the KVStore contract of the store
+func testKVStore(t *testing.T, store KVStore) {
+	if err := store.Set("a", []byte("1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := store.Get("a"); err != nil || "1" != string(val) {
+		t.Error("Get should return the value", string(val), err)
+	}
+
+	if err := store.Set("a", []byte("2"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := store.Get("a"); err != nil || "2" != string(val) {
+		t.Error("Set should overwrite the value", string(val), err)
+	}
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a"); err != ErrNotFound {
+		t.Error("deleted key should be not found", err)
+	}
+
+	store.Set("b", []byte("3"), 0)
+	if val, err := store.GetAndDelete("b"); err != nil || "3" != string(val) {
+		t.Error("GetAndDelete should return the value", string(val), err)
+	}
+	if _, err := store.GetAndDelete("b"); err != ErrNotFound {
+		t.Error("GetAndDelete should return the value only once", err)
+	}
+
+	// Only one of the concurrent takers gets the value
+	store.Set("c", []byte("4"), 60)
+	var wg sync.WaitGroup
+	var taken int
+	var mu sync.Mutex
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.GetAndDelete("c"); err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if 1 != taken {
+		t.Error("the value should be taken exactly once", taken)
+	}
+
+	if n, err := store.Incr("counter", 60); err != nil || 1 != n {
+		t.Error("Incr should start from 0", n, err)
+	}
+	if n, err := store.Incr("counter", 60); err != nil || 2 != n {
+		t.Error("Incr should increment the value", n, err)
+	}
+
+	// The concurrent increments are all counted
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Incr("counter", 60); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if val, err := store.Get("counter"); err != nil || "12" != string(val) {
+		t.Error("the value should be incremented by all calls", string(val), err)
+	}
+
+	store.Set("d", []byte("5"), 1)
+	store.Incr("e", 1)
+	store.Incr("e", 60)
+	time.Sleep(2100 * time.Millisecond)
+	if _, err := store.Get("d"); err != ErrNotFound {
+		t.Error("expired key should be not found", err)
+	}
+	if n, err := store.Incr("e", 60); err != nil || 1 != n {
+		t.Error("the counter should expire in the ttl of the first increment", n, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testKVStore(t, NewMemoryStore(1024*1024))
+}
+
+func TestEntStore(t *testing.T) {
+	ctx, client := CreateClient(t)
+	if client == nil {
+		t.Fatal("failed to create ent client")
+	}
+
+	store := NewEntStore(client)
+	testKVStore(t, store)
+
+	store.Set("e", []byte("6"), 1)
+	time.Sleep(1100 * time.Millisecond)
+	if err := store.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := client.KeyValue.Query().Where(keyvalue.ExpiredAtLTE(time.Now())).Count(ctx); 0 != n {
+		t.Error("expired entries should be purged", n)
+	}
+
+	// The expired entries are purged periodically until the purge is stopped
+	store.Set("f", []byte("7"), 1)
+	purgeCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		store.PurgeEvery(purgeCtx, 100*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(1300 * time.Millisecond)
+	if n, _ := client.KeyValue.Query().Where(keyvalue.IDEQ("f")).Count(ctx); 0 != n {
+		t.Error("expired entries should be purged periodically", n)
+	}
+	stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the purge should be stopped")
+	}
+}
+
+// fakeRedis is an in-process Redis server of the commands used by RedisStore
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	password string
+	legacy   bool // a server before Redis 6.2, which has no GETDEL
+	values   map[string]string
+	expires  map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{listener: listener, password: password, values: map[string]string{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authorized := "" == r.password
+	var queued [][]string // the commands of the transaction, nil if it isn't started
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		array, _ := reply.([]interface{})
+		args := make([]string, len(array))
+		for i, arg := range array {
+			b, _ := arg.([]byte)
+			args[i] = string(b)
+		}
+
+		if 0 == len(args) {
+			conn.Write([]byte("-ERR empty command\r\n"))
+			continue
+		}
+		if "AUTH" == args[0] {
+			authorized = r.password == args[1]
+			if !authorized {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			conn.Write([]byte("+OK\r\n"))
+			continue
+		}
+		if !authorized {
+			conn.Write([]byte("-NOAUTH Authentication required\r\n"))
+			continue
+		}
+
+		switch {
+		case "MULTI" == args[0]:
+			queued = [][]string{}
+			conn.Write([]byte("+OK\r\n"))
+		case "EXEC" == args[0]:
+			replies := "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, command := range queued {
+				replies += r.exec(command)
+			}
+			queued = nil
+			conn.Write([]byte(replies))
+		case queued != nil:
+			queued = append(queued, args)
+			conn.Write([]byte("+QUEUED\r\n"))
+		default:
+			conn.Write([]byte(r.exec(args)))
+		}
+	}
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	get := func(key string) (string, bool) {
+		if exp, ok := r.expires[key]; ok && exp.Before(time.Now()) {
+			delete(r.values, key)
+			delete(r.expires, key)
+		}
+		val, ok := r.values[key]
+		return val, ok
+	}
+	bulk := func(val string, ok bool) string {
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(val)) + "\r\n" + val + "\r\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		r.values[args[1]] = args[2]
+		delete(r.expires, args[1])
+		if 5 == len(args) && "EX" == args[3] {
+			ttl, _ := strconv.Atoi(args[4])
+			r.expires[args[1]] = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+		return "+OK\r\n"
+	case "GET":
+		return bulk(get(args[1]))
+	case "GETDEL":
+		if r.legacy {
+			break
+		}
+		val, ok := get(args[1])
+		delete(r.values, args[1])
+		delete(r.expires, args[1])
+		return bulk(val, ok)
+	case "EVAL":
+		// Only the script of Incr is supported: EVAL script 1 key ttl
+		if redisIncrScript != args[1] || 5 != len(args) {
+			return "-ERR unknown script\r\n"
+		}
+		val, _ := get(args[3])
+		n, err := strconv.ParseInt("0"+val, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		r.values[args[3]] = strconv.FormatInt(n+1, 10)
+		if ttl, _ := strconv.Atoi(args[4]); 0 == n && 0 < ttl {
+			r.expires[args[3]] = time.Now().Add(time.Duration(ttl) * time.Second)
+		}
+		return ":" + strconv.FormatInt(n+1, 10) + "\r\n"
+	case "DEL":
+		_, ok := get(args[1])
+		delete(r.values, args[1])
+		delete(r.expires, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisStore(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+	defer r.listener.Close()
+
+	if _, err := NewRedisStore("redis://:wrong@" + r.listener.Addr().String()); err == nil {
+		t.Error("wrong password should fail")
+	}
+
+	store, err := NewRedisStore("redis://:secret@" + r.listener.Addr().String() + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testKVStore(t, store)
+
+	// The broken connections aren't returned to the pool
+	for n := len(store.idle); 0 < n; n-- {
+		conn := <-store.idle
+		conn.Close()
+		store.idle <- conn
+	}
+	for n := len(store.idle); 0 < n; n-- {
+		store.Get("a")
+	}
+	if err := store.Set("f", []byte("7"), 60); err != nil {
+		t.Error("connection should be reestablished", err)
+	}
+
+	// Concurrent commands use their own connections
+	var wg sync.WaitGroup
+	for i := 0; i < 2*maxRedisIdleConns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "concurrent:" + strconv.Itoa(i)
+			if err := store.Set(key, []byte(key), 60); err != nil {
+				t.Error(err)
+			}
+			if val, err := store.GetAndDelete(key); err != nil || key != string(val) {
+				t.Error("the value of the connection should be its own", key, string(val), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if maxRedisIdleConns < len(store.idle) {
+		t.Error("the idle connections should be at most", maxRedisIdleConns, len(store.idle))
+	}
+}
+
+func TestRedisStoreWithoutGetDel(t *testing.T) {
+	r := newFakeRedis(t, "")
+	r.legacy = true
+	defer r.listener.Close()
+
+	store, err := NewRedisStore("redis://" + r.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testKVStore(t, store)
+	if 1 != store.noGetDel {
+		t.Error("GET and DEL should be used without GETDEL")
+	}
+}
+
+func TestBoxPrefix(t *testing.T) {
+	store := NewMemoryStore(1024 * 1024)
+	a := NewStoreBox(store, "a:", 60)
+	b := NewStoreBox(store, "b:", 60)
+
+	a.SetStringVal("key", "a")
+	b.SetStringVal("key", "b")
+	a.SetIntValI(1, 1)
+
+	if val, _ := a.StringVal("key"); "a" != val {
+		t.Error("boxes of the same store shouldn't share keys", val)
+	}
+	if val, _ := b.StringVal("key"); "b" != val {
+		t.Error("boxes of the same store shouldn't share keys", val)
+	}
+	if _, err := b.IntValI(1); err != ErrNotFound {
+		t.Error("boxes of the same store shouldn't share int keys", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Subject identifiers of the users, see OIDC Core §8.
+// A public subject is the user ID, the same for all services;
+// a pairwise subject is derived from the user, the service and a server secret,
+// so that the services can't correlate the users, nor count them.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/oauth"
+	"whoam.xyz/ent/service"
+)
+
+const keyPairwiseSecret = "pairwise_secret" // the KeyValue entry of the generated pairwise secret
+
+var errNoTokenUser = errors.New("Token has no user")
+
+// pairwiseSecret is the key of the pairwise subjects, changing it changes all pairwise subjects
+var pairwiseSecret []byte
+
+// InitSubject loads the pairwise secret, config.PairwiseSecret or the one kept in the database.
+// The secret is generated and kept in the database at the first start, so that it's shared by whoam servers.
+func InitSubject() {
+	if string(service.SubjectTypePublic) != config.SubjectType && string(service.SubjectTypePairwise) != config.SubjectType {
+		panic("unsupported subject type: " + config.SubjectType)
+	}
+
+	if "" != config.PairwiseSecret {
+		pairwiseSecret = []byte(config.PairwiseSecret)
+		return
+	}
+
+	secret, err := loadPairwiseSecret()
+	if err != nil {
+		panic("failed to load the pairwise secret: " + err.Error())
+	}
+	pairwiseSecret = secret
+}
+
+func loadPairwiseSecret() ([]byte, error) {
+	kv, err := client.KeyValue.Get(ctx, keyPairwiseSecret)
+	if err == nil {
+		return kv.Value, nil
+	}
+	if !ent.IsNotFound(err) {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	// Another server may have kept its secret at the same time, the one kept first is used
+	_, err = client.KeyValue.Create().SetID(keyPairwiseSecret).SetValue(secret).Save(ctx)
+	if ent.IsConstraintError(err) {
+		return loadPairwiseSecret()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// isPairwise reports whether the subjects of the service are pairwise,
+// the main service is whoam itself, its subjects are always public.
+func isPairwise(_service *ent.Service) bool {
+	if MainServiceID == _service.ID {
+		return false
+	}
+	if "" != _service.SubjectType {
+		return service.SubjectTypePairwise == _service.SubjectType
+	}
+	return string(service.SubjectTypePairwise) == config.SubjectType
+}
+
+// subjectOf returns the subject identifier of the user for the service
+func subjectOf(userID int, _service *ent.Service) string {
+	if !isPairwise(_service) {
+		return strconv.Itoa(userID)
+	}
+
+	mac := hmac.New(sha256.New, pairwiseSecret)
+	mac.Write([]byte(_service.ID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.Itoa(userID)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userOfClaims returns the user of the access token.
+// The tokens of pairwise services don't have the user ID in `oti`, the user is of the refresh token family of `sid`.
+// errNoTokenUser is returned if the token has no user, or the user doesn't exist.
+func userOfClaims(claims *StandardClaims) (*ent.User, error) {
+	if 0 != claims.OtherID {
+		_user, err := client.User.Get(ctx, int(claims.OtherID))
+		if ent.IsNotFound(err) {
+			return nil, errNoTokenUser
+		}
+		return _user, err
+	}
+
+	if "" == claims.SessionID {
+		return nil, errNoTokenUser
+	}
+
+	_user, err := client.Oauth.Query().Where(oauth.FamilyEQ(claims.SessionID)).QueryUser().Only(ctx)
+	if ent.IsNotFound(err) {
+		return nil, errNoTokenUser
+	}
+	return _user, err
+}
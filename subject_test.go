@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"whoam.xyz/ent"
+	"whoam.xyz/ent/service"
+)
+
+func createSubjectService(t *testing.T, id string, subjectType service.SubjectType) *ent.Service {
+	creator := client.Service.Create().
+		SetID(id).
+		SetName(id).
+		SetSubject("").
+		SetDomain("https://" + id).
+		SetCloneURI("https://github.com/excing/whoam.git")
+	if "" != subjectType {
+		creator.SetSubjectType(subjectType)
+	}
+
+	_service, err := creator.Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return _service
+}
+
+func TestPairwiseSubject(t *testing.T) {
+	setupOAuth(t)
+
+	_user, err := client.User.Create().SetEmail("pairwise@example.com").Save(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := createSubjectService(t, "first.pairwise.example.com", service.SubjectTypePairwise)
+	second := createSubjectService(t, "second.pairwise.example.com", service.SubjectTypePairwise)
+	public := createSubjectService(t, "public.pairwise.example.com", "")
+
+	sub := subjectOf(_user.ID, first)
+	if sub == strconv.Itoa(_user.ID) {
+		t.Error("pairwise subject shouldn't be the user ID")
+	}
+	if sub != subjectOf(_user.ID, first) {
+		t.Error("pairwise subject should be stable")
+	}
+	if sub == subjectOf(_user.ID, second) {
+		t.Error("pairwise subjects of different services should differ")
+	}
+	if strconv.Itoa(_user.ID) != subjectOf(_user.ID, public) {
+		t.Error("subject of the service following the public default should be the user ID")
+	}
+
+	accessToken, auth, err := newOAuthToken(_user.ID, first.ID, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := FilterJWTToken(accessToken, jwtKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if 0 != claims.OtherID || sub != claims.Subject {
+		t.Errorf("access token of pairwise service: oti = %v, sub = %v, want no oti and %v", claims.OtherID, claims.Subject, sub)
+	}
+
+	if auth.Family != claims.SessionID || strconv.Itoa(auth.ID) == claims.SessionID {
+		t.Error("sid should be the random family of the refresh token, not its record ID", claims.SessionID)
+	}
+
+	tokenUser, err := userOfClaims(claims)
+	if err != nil || tokenUser.ID != _user.ID {
+		t.Error("user of the pairwise access token should be resolved by sid", tokenUser, err)
+	}
+
+	// The rotated refresh token is in the same family
+	accessToken, _, err = refreshOAuthToken(auth.MainToken, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err = FilterJWTToken(accessToken, jwtKeys); err != nil {
+		t.Fatal(err)
+	}
+	if tokenUser, err = userOfClaims(claims); err != nil || tokenUser.ID != _user.ID {
+		t.Error("user of the rotated family should be resolved by sid", tokenUser, err)
+	}
+
+	idToken, err := NewIDToken(_user, first, "openid", "", 0, jwtKeys.SigningKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idClaims := &IDTokenClaims{}
+	if err = parseJWT(idToken, jwtKeys, typeIDToken, idClaims); err != nil || sub != idClaims.Subject {
+		t.Error("id_token should have the same pairwise subject", idClaims, err)
+	}
+}
+
+func TestDefaultSubjectType(t *testing.T) {
+	setupOAuth(t)
+
+	defer func(subjectType string) { config.SubjectType = subjectType }(config.SubjectType)
+	config.SubjectType = string(service.SubjectTypePairwise)
+
+	_service := createSubjectService(t, "default.pairwise.example.com", "")
+	if !isPairwise(_service) {
+		t.Error("service without subject type should follow the pairwise default")
+	}
+
+	main, err := client.Service.Get(ctx, MainServiceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isPairwise(main) {
+		t.Error("subjects of the main service should be public")
+	}
+}
@@ -1,25 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"net/http"
 	"strings"
-	"text/template"
 	"time"
 
-	"whoam.xyz/ent/user"
-)
-
-const (
-	verificationTlp = `<body style="font-family: Roboto, sans-serif">
-  <p>Hello, Welcome to whoam. You are using Email Verification Code to login to <a href="https://whoam.xyz">WHOAM</a>
-  <p><big>Verification code: <b>{{ . }}</b>.</big>
-  <p>It's valid within <b>15 minutes.</b>
-  <p>If this isn't your own operating, please ignore this email.
-  <p>Please don't reply!
-    <hr>
-  <p>Thank you,<p style="margin: 0 auto; font-size: 1.5em;">The ThreeTenth team
-</body>`
+	"github.com/pkg/errors"
+	"whoam.xyz/ent"
 )
 
 const timeoutUserVerification = 900             // 用户验证码有效时长: 15分钟
@@ -28,19 +15,22 @@ const timeoutAccessToken = 7 * time.Minute      // user access token timeout: 7m
 
 // 用户登录验证信息
 var userVerificaBox *Box
+
 var oauthCodeBox *Box
-var signingKey []byte
 
 // InitUser initialize User related
 func InitUser() {
-	// size: 3M
 	// default timeout: 15min
-	userVerificaBox = NewBox(3*1024*1024, 15*60)
-	// size: 3M
+	userVerificaBox = NewStoreBox(kvStore, "verification:", 15*60)
 	// default timeout: 5min
-	oauthCodeBox = NewBox(3*1024*1024, 5*60)
-
-	signingKey = []byte(New32BitID())
+	oauthCodeBox = NewStoreBox(kvStore, "oauth_code:", 5*60)
+	// default timeout: the access token timeout
+	revokedTokenBox = NewStoreBox(dbStore, "revoked:", int(timeoutAccessToken.Seconds()))
+
+	window := time.Duration(config.RateLimitWindow) * time.Minute
+	emailRateLimiter = NewRateLimiter(config.RateLimitEmail, window)
+	ipRateLimiter = NewRateLimiter(config.RateLimitIP, window)
+	pollRateLimiter = NewRateLimiter(maxLoginPolls, timeoutUserVerification*time.Second)
 }
 
 type userVerificationForm struct {
@@ -48,6 +38,17 @@ type userVerificationForm struct {
 	State string `json:"state" binding:"required" note:"This parameter should be consistent with the state in /user/main/login"`
 	Code  string `json:"code" binding:"required"`
 	Token string `json:"token" binding:"required"`
+
+	Request *loginRequest `json:"request,omitempty" note:"It is set by the server"`
+}
+
+// loginRequest is the client which requested the verification code, it's shown on the page of the magic link,
+// so that the user can tell whether the login is requested by themselves
+type loginRequest struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Time      int64  `json:"time"`
+	MatchCode string `json:"matchCode" note:"The short code shown on both the login page and the page of the magic link"`
 }
 
 // PostMainAuth 用户登录授权验证
@@ -58,6 +59,10 @@ func PostMainAuth(c *Context) error {
 		return c.BadRequest(err.Error())
 	}
 
+	if !allowRequest(c, "auth", dst.Email) {
+		return c.TooManyRequests("Too many login attempts, please try again later")
+	}
+
 	var src userVerificationForm
 	err = userVerificaBox.Val(dst.Token, &src)
 
@@ -65,59 +70,125 @@ func PostMainAuth(c *Context) error {
 		return c.Unauthorized("Verification failed: token is invalid or code is expired")
 	}
 
-	if src.Code != strings.ToTitle(dst.Code) {
+	if !equalString(src.Code, strings.ToTitle(dst.Code)) {
+		failVerification(dst.Token)
 		return c.Unauthorized("Verification failed: code is invalid")
 	}
-	if src.Token != dst.Token {
+	if !equalString(src.Token, dst.Token) {
+		failVerification(dst.Token)
 		return c.Unauthorized("Verification failed: token is invalid")
 	}
 	if src.State != dst.State {
+		failVerification(dst.Token)
 		return c.Unauthorized("Verification failed: state is invalid")
 	}
 	if src.Email != dst.Email {
+		failVerification(dst.Token)
 		return c.Unauthorized("Verification failed: email is invalid")
 	}
 
-	user, err := client.User.Query().Where(user.EmailEQ(src.Email)).Only(ctx)
-	if err != nil {
-		user, err = client.User.Create().SetEmail(src.Email).Save(ctx)
-		if err != nil {
-			return c.InternalServerError(err.Error())
-		}
+	// The verification token is single-use, only one of the concurrent requests takes it
+	if _, err = userVerificaBox.Take(dst.Token); err != nil {
+		return c.Unauthorized("Verification failed: token is invalid or code is expired")
 	}
+	userVerificaBox.DelString("attempts:" + dst.Token)
 
-	// accessToken := New64BitID()
-	accessToken, err := NewJWTToken(user.ID, MainServiceID, timeoutAccessToken, signingKey)
+	return loginMain(c, src.Email)
+}
 
+// loginMain logs the user of the email in to whoam, the user is created on the first login.
+// The user can log in with any verified email of it.
+// The browser session is kept in the session cookie, and its CSRF token is returned.
+// API clients without cookies use the returned whoam access token and refresh token (mainToken) instead,
+// the web UI doesn't keep them.
+func loginMain(c *Context, email string) error {
+	_user, err := userOfEmail(email)
+	if ent.IsNotFound(err) {
+		_user, err = createUser(email)
+	}
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	mainToken := New64BitID()
-
-	auth, err := client.Oauth.Create().
-		SetMainToken(mainToken).
-		SetExpiredAt(time.Now().Add(timeoutRefreshToken)).
-		SetUser(user).
-		SetServiceID(MainServiceID).
-		Save(ctx)
-
+	_session, err := newSession(c, _user.ID)
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	userVerificaBox.DelString(dst.Token)
+	accessToken, auth, err := newOAuthToken(_user.ID, MainServiceID, "")
+	if err != nil {
+		return c.InternalServerError(err.Error())
+	}
 
 	return c.Ok(
 		struct {
+			CSRFToken   string `json:"csrfToken"`
 			AccessToken string `json:"accessToken"`
 			MainToken   string `json:"mainToken"`
 		}{
+			CSRFToken:   _session.CsrfToken,
 			AccessToken: accessToken,
 			MainToken:   auth.MainToken,
 		})
 }
 
+// mainUserOf returns the user of the whoam access token of the request,
+// or the user of the browser session if there is no access token.
+// The state-changing requests of the browser session must have its CSRF token.
+func mainUserOf(c *Context) (*ent.User, error) {
+	accessToken := accessTokenOf(c)
+	if "" == accessToken {
+		var _session *ent.Session
+		var err error
+		if http.MethodGet == c.Request.Method || http.MethodHead == c.Request.Method {
+			if _session = sessionOf(c); _session == nil {
+				err = errNoSession
+			}
+		} else {
+			_session, err = csrfSessionOf(c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return _session.Edges.User, nil
+	}
+
+	claims, err := FilterJWTToken(accessToken, jwtKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Audience != MainServiceID {
+		return nil, errors.New("Only whoam access token is accepted")
+	}
+
+	return userOfClaims(claims)
+}
+
+// isAdmin reports whether the user is an administrator of config.Admins
+func isAdmin(_user *ent.User) bool {
+	for _, email := range strings.Split(config.Admins, ",") {
+		if "" != strings.TrimSpace(email) && strings.EqualFold(strings.TrimSpace(email), _user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// failVerification counts a failed attempt of the verification token,
+// the token is invalidated after config.MaxCodeAttempts failures.
+// The counter is incremented in the store, so that it's shared by whoam servers of the same store.
+func failVerification(token string) {
+	key := "attempts:" + token
+	attempts, err := userVerificaBox.Incr(key)
+
+	// The token can't be guessed without counting the attempts
+	if err != nil || attempts >= config.MaxCodeAttempts {
+		userVerificaBox.DelString(token)
+		userVerificaBox.DelString(key)
+	}
+}
+
 type userLoginForm struct {
 	Email string `json:"email" binding:"required"`
 	State string `json:"state" binding:"required" note:"random number"`
@@ -135,29 +206,50 @@ func PostMainCode(c *Context) error {
 		return c.BadRequest("Email is invalid")
 	}
 
-	code := New4BitID()
-	t, err := template.New("login").Parse(verificationTlp)
+	if !allowRequest(c, "code", form.Email) {
+		return c.TooManyRequests("Too many verification codes requested, please try again later")
+	}
+
+	code := NewVerificationCode()
+	token := New64BitID()
+	request := &loginRequest{
+		IP:        clientIP(c),
+		UserAgent: c.Request.UserAgent(),
+		Time:      time.Now().Unix(),
+		MatchCode: NewMatchCode(),
+	}
+
+	link, err := newApprovalLink(token, form.Email)
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	var buf bytes.Buffer
-	err = t.Execute(&buf, code)
+	body, err := renderTemplate(c.Locale(), tlpMailVerification, struct {
+		Code string
+		Link string
+	}{code, link})
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	// err = SendMail(email, "Login WHOAM with verification code", buf.String())
-	fmt.Println(buf.String())
+	// The code is stored before it's sent, so that it can be verified as soon as it's received
+	err = userVerificaBox.SetVal(token, userVerificationForm{Email: form.Email, State: form.State, Code: code, Token: token, Request: request})
 	if err != nil {
 		return c.InternalServerError(err.Error())
 	}
 
-	token := New64BitID()
-	err = userVerificaBox.SetVal(token, userVerificationForm{form.Email, form.State, code, token})
+	err = EnqueueMail(form.Email, c.T("Login WHOAM with verification code"), body)
 	if err != nil {
+		userVerificaBox.DelString(token)
 		return c.InternalServerError(err.Error())
 	}
 
-	return c.Ok(token)
+	return c.Ok(
+		struct {
+			Token     string `json:"token"`
+			MatchCode string `json:"matchCode"`
+		}{
+			Token:     token,
+			MatchCode: request.MatchCode,
+		})
 }
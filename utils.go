@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
-	"math/rand"
+	"crypto/rand"
+	"crypto/subtle"
+	"math"
 	"net"
 	"regexp"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -51,9 +54,15 @@ func ExternalIP() (string, error) {
 	return "", errors.New("are you connected to the network?")
 }
 
+// equalString reports whether a and b are equal in constant time,
+// it's used to compare secrets, and only leaks whether their lengths are equal.
+func equalString(a, b string) bool {
+	return 1 == subtle.ConstantTimeCompare([]byte(a), []byte(b))
+}
+
 // VerifyEmailFormat Verify email address
 func VerifyEmailFormat(email string) bool {
-	pattern := `\w+([-+.]\w+)*@\w+([-.]\w+)*\.\w+([-.]\w+)*` // email regular expression
+	pattern := `^\w+([-+.]\w+)*@\w+([-.]\w+)*\.\w+([-.]\w+)*$` // email regular expression
 	reg := regexp.MustCompile(pattern)
 	return reg.MatchString(email)
 }
@@ -63,39 +72,78 @@ const digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghijklmnopqrstuvwxyz_.
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
 	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
+// dictOf returns the characters of the m base, see RandNdigMbitString
+func dictOf(m ...int) string {
+	if 1 == len(m) {
+		return digits[0:m[0]]
+	} else if 2 == len(m) {
+		return digits[m[0] : m[0]+m[1]]
+	}
+	return digits
+}
 
 // RandNdigMbitString returns a randomly generated string with n digits and m base,
-// the string range is: a-z, A-Z, 0-9 and'_','.' symbols
-// see: https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go?answertab=votes#tab-top
+// the string range is: a-z, A-Z, 0-9 and'_','.' symbols.
+// The random bytes are read from crypto/rand, and a 6 bits index out of the base is discarded,
+// so that every character has the same probability.
 func RandNdigMbitString(n int, m ...int) string {
 	b := make([]byte, n)
-	dict := digits
-	if 1 == len(m) {
-		dict = digits[0:m[0]]
-	} else if 2 == len(m) {
-		dict = digits[m[0] : m[0]+m[1]]
-	}
+	dict := dictOf(m...)
 
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	// On average, at least len(dict)/64 of the random bytes are used
+	cache := make([]byte, n*(1<<letterIdxBits)/len(dict)+1)
+	for i := 0; i < n; {
+		if _, err := rand.Read(cache); err != nil {
+			panic("failed to read random bytes: " + err.Error())
 		}
-		if idx := int(cache & letterIdxMask); idx < len(dict) {
-			b[i] = dict[idx]
-			i--
+		for _, r := range cache {
+			if idx := int(r & letterIdxMask); idx < len(dict) {
+				b[i] = dict[idx]
+				i++
+				if i == n {
+					break
+				}
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
 
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// RandEntropyString returns a random string of m base with at least the bits of entropy
+func RandEntropyString(bits int, m ...int) string {
+	n := int(math.Ceil(float64(bits) / math.Log2(float64(len(dictOf(m...))))))
+	if n < 1 {
+		n = 1
+	}
+	return RandNdigMbitString(n, m...)
+}
+
+// NewVerificationCode returns a new email verification code of config.CodeEntropy bits,
+// 10 numbers + 26 uppercase letters
+func NewVerificationCode() string {
+	return RandEntropyString(config.CodeEntropy, 36)
+}
+
+// NewMatchCode returns a new code of 2 numbers, which matches the login page with the page of the magic link
+func NewMatchCode() string {
+	return RandNdigMbitString(2, 26, 10)
+}
+
+// NewOAuthCode returns a new OAuth authorization code of config.OAuthCodeEntropy bits,
+// 10 numbers + 26 lowercase letters
+func NewOAuthCode() string {
+	return RandEntropyString(config.OAuthCodeEntropy, 26, 36)
+}
+
+// NewRefreshToken returns a new refresh token of config.TokenEntropy bits,
+// 10 numbers + 26 lowercase letters + 26 uppercase letters + (_, .)
+func NewRefreshToken() string {
+	return RandEntropyString(config.TokenEntropy)
+}
+
 // New128BitID Get a 128-base random string,
 // 10 numbers + 26 lowercase letters + 26 uppercase letters + (=, _), length 64
 func New128BitID() string {
@@ -144,51 +192,100 @@ func New4bitID() string {
 	return RandNdigMbitString(4, 26, 36)
 }
 
+// typeAccessToken is the `typ` header of access tokens, see RFC 9068 §2.1.
+// Other JWTs signed by the same keys, such as id_tokens, don't have it, so they aren't accepted as access tokens.
+const typeAccessToken = "at+jwt"
+
 // StandardClaims whoam's standard claims struct
 type StandardClaims struct {
-	OtherID int64 `json:"oti"`
+	OtherID   int64  `json:"oti,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	Scope     string `json:"scope,omitempty"`
 	jwt.StandardClaims
 }
 
-// NewJWTToken create new JWT access token
-func NewJWTToken(userID int, serviceID string, exp time.Duration, signingKey []byte) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, &StandardClaims{
-		int64(userID),
+// NewJWTToken create new JWT access token with the granted scope, signed by the key.
+// The sessionID is the refresh token family from which the access token is issued,
+// the access token is revoked with the family.
+// The tokens of pairwise services don't have the user ID, see subjectOf.
+func NewJWTToken(userID int, _service *ent.Service, sessionID string, scope string, exp time.Duration, key *JWTKey) (string, error) {
+	var otherID int64
+	if !isPairwise(_service) {
+		otherID = int64(userID)
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(key.Method, &StandardClaims{
+		otherID,
+		sessionID,
+		scope,
 		jwt.StandardClaims{
-			Audience:  serviceID,
-			ExpiresAt: time.Now().Add(exp).Unix(),
+			Id:        New32bitID(),
+			Issuer:    issuer(),
+			Subject:   subjectOf(userID, _service),
+			Audience:  _service.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(exp).Unix(),
 		},
 	})
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typeAccessToken
 
-	return token.SignedString(signingKey)
+	return token.SignedString(key.PrivateKey)
 }
 
-// FilterJWTToken return nil, if parse token failed, return error
-func FilterJWTToken(tokenString string, signingKey []byte) (*StandardClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return signingKey, nil
+// FilterJWTToken return nil, if parse token failed, return error.
+// The token must be an access token with a `jti`, verified by the key of its `kid` header in the keys,
+// and must not be revoked.
+func FilterJWTToken(tokenString string, keys *KeySet) (*StandardClaims, error) {
+	claims := &StandardClaims{}
+	if err := parseJWT(tokenString, keys, typeAccessToken, claims); err != nil {
+		return nil, err
+	}
+
+	if "" == claims.Id {
+		return nil, errNoTokenID
+	}
+	if isTokenRevoked(claims) {
+		return nil, errors.New("Token has been revoked")
+	}
+	return claims, nil
+}
+
+// parseJWT verifies the JWT of the `typ` header into the claims,
+// by the key of its `kid` header in the keys.
+// The media type form of the typ, such as application/at+jwt, is accepted, see RFC 8725 §3.11.
+func parseJWT(tokenString string, keys *KeySet, typ string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if t, _ := token.Header["typ"].(string); !strings.EqualFold(t, typ) && !strings.EqualFold(t, "application/"+typ) {
+			return nil, errors.Errorf("Unexpected token type: %v", t)
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keys.Key(kid)
+		if !ok {
+			return nil, errors.Errorf("Unknown signing key: %v", kid)
+		}
+		if key.Method.Alg() != token.Method.Alg() {
+			return nil, errors.Errorf("Unexpected signing method: %v", token.Method.Alg())
+		}
+		return key.PublicKey(), nil
 	})
 
 	if ve, ok := err.(*jwt.ValidationError); ok {
 		if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-			return nil, errors.New("That's not even a token")
+			return errors.New("That's not even a token")
 		} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
 			// Token is either expired or not active yet
-			return nil, errors.New("Timing is everything")
+			return errors.New("Timing is everything")
 		} else {
-			return nil, errors.New("Couldn't handle this token:" + err.Error())
+			return errors.New("Couldn't handle this token:" + err.Error())
 		}
 	}
 
 	if !token.Valid {
-		return nil, errors.New("Couldn't handle this token")
+		return errors.New("Couldn't handle this token")
 	}
-
-	if ve, ok := token.Claims.(*StandardClaims); ok {
-		return ve, nil
-	}
-
-	return nil, errors.New("Token claims isn't jwt.StandardClaims")
+	return nil
 }
 
 // WithTx best Practices, reusable function that runs callbacks in a transaction
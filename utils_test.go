@@ -1,9 +1,17 @@
 package main
 
 import (
+	"math"
+	"strings"
 	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"whoam.xyz/ent"
 )
 
+var exampleService = &ent.Service{ID: "example.com"}
+
 func TestGen(t *testing.T) {
 	t.Log(RandNdigMbitString(4))
 	t.Log(RandNdigMbitString(4, 16))
@@ -37,10 +45,194 @@ func TestNew128BitID(t *testing.T) {
 	}
 }
 
+// chiSquareCritical returns the approximate critical value of the chi-square distribution
+// with df degrees of freedom at the significance level of about 1e-5, see Wilson–Hilferty
+func chiSquareCritical(df int) float64 {
+	const z = 4.265
+	k := float64(df)
+	return k * math.Pow(1-2/(9*k)+z*math.Sqrt(2/(9*k)), 3)
+}
+
+// chiSquare returns the chi-square statistic of the observed counts against the uniform distribution
+func chiSquare(counts map[byte]int, dict string, total int) float64 {
+	expected := float64(total) / float64(len(dict))
+	var x2 float64
+	for i := 0; i < len(dict); i++ {
+		d := float64(counts[dict[i]]) - expected
+		x2 += d * d / expected
+	}
+	return x2
+}
+
+func TestRandNdigMbitStringDistribution(t *testing.T) {
+	for _, m := range [][]int{{}, {16}, {36}, {26, 36}} {
+		dict := dictOf(m...)
+		counts := make(map[byte]int)
+		total := 0
+		for i := 0; i < 2000; i++ {
+			s := RandNdigMbitString(64, m...)
+			for j := 0; j < len(s); j++ {
+				if strings.IndexByte(dict, s[j]) < 0 {
+					t.Fatalf("unexpected character %q of base %v", s[j], m)
+				}
+				counts[s[j]]++
+				total++
+			}
+		}
+
+		if x2, crit := chiSquare(counts, dict, total), chiSquareCritical(len(dict)-1); x2 > crit {
+			t.Errorf("biased distribution of base %v: chi-square %.2f > %.2f", m, x2, crit)
+		}
+	}
+}
+
+func TestRandNdigMbitStringPositions(t *testing.T) {
+	// Every position of a short verification code must be uniform too
+	dict := dictOf(36)
+	counts := make([]map[byte]int, 4)
+	for i := range counts {
+		counts[i] = make(map[byte]int)
+	}
+	const samples = 20000
+	for i := 0; i < samples; i++ {
+		s := RandNdigMbitString(4, 36)
+		for j := 0; j < len(s); j++ {
+			counts[j][s[j]]++
+		}
+	}
+
+	for j, c := range counts {
+		if x2, crit := chiSquare(c, dict, samples), chiSquareCritical(len(dict)-1); x2 > crit {
+			t.Errorf("biased distribution of position %d: chi-square %.2f > %.2f", j, x2, crit)
+		}
+	}
+}
+
+func TestRandNdigMbitStringUnique(t *testing.T) {
+	set := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		s := New32bitID()
+		if set[s] {
+			t.Fatal("duplicate id", s)
+		}
+		set[s] = true
+	}
+}
+
+func TestRandEntropyString(t *testing.T) {
+	tests := []struct {
+		bits int
+		m    []int
+		n    int
+	}{
+		{20, []int{36}, 4},
+		{160, []int{26, 36}, 31},
+		{384, nil, 64},
+		{128, []int{16}, 32},
+		{0, nil, 1},
+	}
+
+	for _, tt := range tests {
+		if s := RandEntropyString(tt.bits, tt.m...); len(s) != tt.n {
+			t.Errorf("RandEntropyString(%v, %v) length = %v, want %v", tt.bits, tt.m, len(s), tt.n)
+		}
+	}
+}
+
 func TestNewJWTToken(t *testing.T) {
-	signKey := []byte(New16BitID())
-	tokenString, err := NewJWTToken(3, "example.com", timeoutAccessToken, signKey)
-	t.Log(tokenString, err)
-	value, err := FilterJWTToken(tokenString, signKey)
-	t.Log(value, err)
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := NewJWTKey(alg)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		tokenString, err := NewJWTToken(3, exampleService, "1", "openid", timeoutAccessToken, key)
+		t.Log(tokenString, err)
+		value, err := FilterJWTToken(tokenString, NewKeySet(key))
+		if err != nil || 3 != value.OtherID {
+			t.Error(alg, value, err)
+		}
+	}
+}
+
+func TestFilterJWTTokenWithRetiredKey(t *testing.T) {
+	retired, _ := NewJWTKey("EdDSA")
+	current, _ := NewJWTKey("ES256")
+	tokenString, _ := NewJWTToken(3, exampleService, "1", "openid", timeoutAccessToken, retired)
+
+	if _, err := FilterJWTToken(tokenString, NewKeySet(current, retired)); err != nil {
+		t.Error("token signed by the retired key should be verified", err)
+	}
+	if _, err := FilterJWTToken(tokenString, NewKeySet(current)); err == nil {
+		t.Error("token signed by the deleted key shouldn't be verified")
+	}
+}
+
+func TestFilterJWTTokenType(t *testing.T) {
+	key, _ := NewJWTKey("EdDSA")
+	keys := NewKeySet(key)
+
+	idToken, err := NewIDToken(&ent.User{ID: 3}, exampleService, "openid", "", 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FilterJWTToken(idToken, keys); err == nil {
+		t.Error("id_token shouldn't be accepted as an access token")
+	}
+
+	// A JWT of the access token type, but without jti
+	token := jwt.NewWithClaims(key.Method, &StandardClaims{OtherID: 3, StandardClaims: jwt.StandardClaims{Audience: "example.com"}})
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typeAccessToken
+	noJTI, _ := token.SignedString(key.PrivateKey)
+	if _, err = FilterJWTToken(noJTI, keys); err == nil {
+		t.Error("access token without jti shouldn't be accepted")
+	}
+	if err = revokeAccessToken(&StandardClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()}}); err != errNoTokenID {
+		t.Error("token without jti shouldn't be revoked", err)
+	}
+}
+
+func TestFilterRevokedJWTToken(t *testing.T) {
+	revokedTokenBox = NewBox(3*1024*1024, 60)
+	defer func() { revokedTokenBox = nil }()
+
+	key, _ := NewJWTKey("EdDSA")
+	keys := NewKeySet(key)
+	first, _ := NewJWTToken(3, exampleService, "1", "openid", timeoutAccessToken, key)
+	second, _ := NewJWTToken(3, exampleService, "1", "openid", timeoutAccessToken, key)
+	other, _ := NewJWTToken(3, exampleService, "2", "openid", timeoutAccessToken, key)
+
+	claims, err := FilterJWTToken(first, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeAccessToken(claims)
+	if _, err := FilterJWTToken(first, keys); err == nil {
+		t.Error("revoked access token should be rejected")
+	}
+	if _, err := FilterJWTToken(second, keys); err != nil {
+		t.Error("other access token shouldn't be revoked", err)
+	}
+
+	revokedTokenBox.SetBoolVal("sid:1", true)
+	if _, err := FilterJWTToken(second, keys); err == nil {
+		t.Error("access token of the revoked session should be rejected")
+	}
+	if _, err := FilterJWTToken(other, keys); err != nil {
+		t.Error("access token of other session shouldn't be revoked", err)
+	}
+}
+
+func TestVerifyEmailFormat(t *testing.T) {
+	for _, email := range []string{"aoli@example.com", "a.o-li+whoam@mail.example.com"} {
+		if !VerifyEmailFormat(email) {
+			t.Error("the email should be valid", email)
+		}
+	}
+
+	for _, email := range []string{"", "aoli", "aoli@example", "Aoli <aoli@example.com>", "aoli@example.com\r\nBcc: evil@example.com", " aoli@example.com"} {
+		if VerifyEmailFormat(email) {
+			t.Errorf("the email should be invalid: %q", email)
+		}
+	}
 }
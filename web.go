@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"whoam.xyz/ent"
@@ -14,8 +15,6 @@ import (
 // 2. Switch to the loginEndpoint page when the auth page is not logged in
 // 3. Direct browser call
 func loginEndpoint(c *Context) error {
-	token := c.MustGet("token").(*StandardClaims)
-	fmt.Println(token)
 	return c.OkHTML(tlpUserLogin, nil)
 }
 
@@ -31,7 +30,7 @@ func oauthEndpoint(c *Context) error {
 		ClientID    string `form:"client_id" binding:"required"`
 		RedirectURI string `form:"redirect_uri" binding:"required,url"`
 		ReturnTo    string `form:"return_to"`
-		State       string `form:"state" binding:"required"`
+		State       string `form:"state"`
 	}
 	err := c.ShouldBindQuery(&query)
 	if err != nil {
@@ -43,45 +42,122 @@ func oauthEndpoint(c *Context) error {
 		return c.BadRequest(err.Error())
 	}
 
-	var response struct {
-		Authorizated bool
-		User         *ent.User
-		Service      *ent.Service
+	if _, ok := matchRedirectURI(_service, query.RedirectURI); !ok {
+		return c.BadRequest("Unregistered redirect_uri: %v", query.RedirectURI)
+	}
+
+	return renderOAuthPage(c, _service, query.RedirectURI, nil)
+}
+
+// authorizeEndpoint the authorization endpoint of RFC 6749 §3.1,
+// only the authorization code grant is supported.
+// If the client or redirect_uri is invalid, the error is shown to the user,
+// otherwise the error is redirected to the client, see RFC 6749 §4.1.2.1
+func authorizeEndpoint(c *Context) error {
+	var query authorizeRequest
+	err := c.ShouldBindQuery(&query)
+	if err != nil {
+		return c.BadRequest(err.Error())
 	}
 
-	token := c.MustGet("token").(*StandardClaims)
-	if token == nil {
-		return c.OkHTML(tlpUserOAuth, &response)
+	if "" == query.ClientID {
+		return c.BadRequest("Missing 'client_id' parameter")
 	}
 
-	_user, err := client.User.Get(ctx, int(token.OtherID))
+	_service, err := client.Service.Query().Where(service.IDEQ(query.ClientID)).First(ctx)
 	if err != nil {
-		return c.OkHTML(tlpUserOAuth, &response)
+		return c.BadRequest("Invalid client_id: %v", query.ClientID)
 	}
 
-	response.Authorizated = true
-	response.User = _user
-	response.Service = _service
+	redirectURI, ok := matchRedirectURI(_service, query.RedirectURI)
+	if !ok {
+		return c.BadRequest("Unregistered redirect_uri: %v", query.RedirectURI)
+	}
+	query.RedirectURI = redirectURI
 
-	return c.OkHTML(tlpUserOAuth, &response)
-}
+	switch query.ResponseType {
+	case "code":
+	case "":
+		return query.redirectError(c, invalidRequest("Missing 'response_type' parameter"))
+	default:
+		return query.redirectError(c, unsupportedResponseType("Only the 'code' response type is supported"))
+	}
 
-// AuthRequired middleware just in the "authorized" group.
-func AuthRequired(c *gin.Context) {
-	_jwtToken, err := FilterJWTToken(c.GetHeader("Authorization"), signingKey)
-	if err != nil {
-		if accessToken, err := c.Cookie("access_token"); err == nil {
-			_jwtToken, _ = FilterJWTToken(accessToken, signingKey)
+	method, oe := checkCodeChallenge(_service, query.CodeChallenge, query.CodeChallengeMethod)
+	if oe != nil {
+		return query.redirectError(c, oe)
+	}
+
+	scopes, oe := checkScope(_service, query.Scope)
+	if oe != nil {
+		return query.redirectError(c, oe)
+	}
+
+	prompts := strings.Fields(query.Prompt)
+
+	_session := sessionOf(c)
+	if _session == nil {
+		if containsString(prompts, "none") {
+			return query.redirectError(c, loginRequired("The user isn't logged in"))
 		}
+		return renderOAuthPage(c, _service, redirectURI, scopes)
 	}
 
-	if _jwtToken != nil {
-		if _jwtToken.Audience != MainServiceID {
-			_jwtToken = nil
+	// The user has consented all the requested scopes, skip the consent page
+	if !containsString(prompts, "consent") && isGranted(_session.Edges.User.ID, _service.ID, scopes) {
+		code, err := issueOAuthCode(&userOAuth{
+			UserID:              _session.Edges.User.ID,
+			ClientID:            _service.ID,
+			RedirectURI:         c.Query("redirect_uri"),
+			CodeChallenge:       query.CodeChallenge,
+			CodeChallengeMethod: method,
+			Scope:               strings.Join(scopes, " "),
+			Nonce:               query.Nonce,
+			AuthTime:            _session.CreatedAt.Unix(),
+		})
+		if err != nil {
+			return query.redirectError(c, serverError(err))
 		}
+
+		return c.Found(query.redirectURL(url.Values{"code": {code}}))
 	}
 
-	c.Set("token", _jwtToken)
+	if containsString(prompts, "none") {
+		return query.redirectError(c, consentRequired("The user hasn't consented the requested scopes"))
+	}
+
+	return renderOAuthPage(c, _service, redirectURI, scopes)
+}
+
+// renderOAuthPage renders the page which the user consents the scopes to the service,
+// redirectURI is the registered redirect URI to which the user is redirected after authorization.
+func renderOAuthPage(c *Context, _service *ent.Service, redirectURI string, scopes []string) error {
+	var response struct {
+		Authorizated bool
+		User         *ent.User
+		Service      *ent.Service
+		RedirectURI  string
+		Scopes       []scopeInfo
+		CSRFToken    string
+	}
+
+	response.Service = _service
+	response.RedirectURI = redirectURI
+	response.Scopes = scopeInfos(scopes)
+
+	if _session := sessionOf(c); _session != nil {
+		response.Authorizated = true
+		response.User = _session.Edges.User
+		response.CSRFToken = _session.CsrfToken
+	}
+
+	return c.OkHTML(tlpUserOAuth, &response)
+}
+
+// AuthRequired middleware just in the "authorized" group,
+// it loads the browser session of the request, which is nil if the user isn't logged in.
+func AuthRequired(c *gin.Context) {
+	sessionOf(&Context{c})
 
 	c.Next()
 }